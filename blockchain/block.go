@@ -14,11 +14,21 @@ type Block struct {
 	PrevHash     []byte
 	Nonce        int
 	Height       int
+	Signature    []byte // proof of authority seal
+	MerkleRoot   []byte // only set once the transactions are pruned
+}
+
+func (b *Block) IsPruned() bool {
+	return len(b.Transactions) == 0
 }
 
 func (b *Block) HashTransactions() []byte {
 	var txHashes [][]byte
 
+	if b.IsPruned() && b.MerkleRoot != nil {
+		return b.MerkleRoot
+	}
+
 	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.Serialize())
 	}
@@ -27,19 +37,22 @@ func (b *Block) HashTransactions() []byte {
 	return tree.RootNode.Data
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
+// NewBlock returns an unsealed block, Hash and Nonce are set once the proof of work is found
+func NewBlock(txs []*Transaction, prevHash []byte, height int) *Block {
+	return &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height, nil, nil}
+}
 
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
+func CreateBlock(txs []*Transaction, prevHash []byte, height int) (*Block, error) {
+	block := NewBlock(txs, prevHash, height)
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+	if err := Engine.Seal(block); err != nil {
+		return nil, err
+	}
 
-	return block
+	return block, nil
 }
 
-func Genesis(coinbase *Transaction) *Block {
+func Genesis(coinbase *Transaction) (*Block, error) {
 	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
 }
 
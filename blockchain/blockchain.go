@@ -2,9 +2,7 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
 	"encoding/gob"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -12,8 +10,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/nclv/golang-blockchain/wallet"
 )
 
 const (
@@ -22,8 +22,9 @@ const (
 )
 
 type BlockChain struct {
-	LastHash []byte
-	Database *badger.DB
+	LastHash  []byte
+	Database  *badger.DB
+	utxoCache *utxoCache
 }
 
 func DBexists(path string) bool {
@@ -73,25 +74,26 @@ func InitBlockChain(address, nodeId string) *BlockChain {
 		log.Panic(err)
 	}
 
-	var lastHash []byte
-	if err := db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := Genesis(cbtx)
-		fmt.Println("Genesis created")
+	cbtx := CoinbaseTx(address, genesisData)
+	genesis, err := Genesis(cbtx)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("Genesis created")
 
+	if err := db.Update(func(txn *badger.Txn) error {
 		if err = txn.Set(genesis.Hash, genesis.Serialize()); err != nil {
 			log.Panic(err)
 		}
-		err = txn.Set([]byte("lh"), genesis.Hash)
-
-		lastHash = genesis.Hash
-
-		return err
+		return txn.Set([]byte("lh"), genesis.Hash)
 	}); err != nil {
 		log.Panic(err)
 	}
 
-	blockchain := BlockChain{lastHash, db}
+	blockchain := BlockChain{genesis.Hash, db, newUTXOCache()}
+	if err := (UTXOSet{&blockchain}).Connect(genesis); err != nil {
+		log.Panic(err)
+	}
 
 	return &blockchain
 }
@@ -121,67 +123,117 @@ func ContinueBlockChain(nodeId string) *BlockChain {
 		log.Panic(err)
 	}
 
-	blockchain := BlockChain{lastHash, db}
+	blockchain := BlockChain{lastHash, db, newUTXOCache()}
+	UTXOSet := UTXOSet{&blockchain}
+	UTXOSet.Migrate()
+	UTXOSet.CatchUp()
 
 	return &blockchain
 }
 
-func (chain *BlockChain) AddBlock(block *Block) {
+// Close flushes the UTXO cache and closes the database
+func (chain *BlockChain) Close() error {
+	UTXOSet{chain}.Flush()
+
+	return chain.Database.Close()
+}
+
+// AddBlock stores a block and returns true when it becomes the new tip, the
+// UTXO set then follows the blocks disconnected and connected by the change
+func (chain *BlockChain) AddBlock(block *Block) bool {
+	known := false
+
 	if err := chain.Database.Update(func(txn *badger.Txn) error {
 		if _, err := txn.Get(block.Hash); err == nil {
+			known = true
 			return nil
 		}
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		if err != nil {
-			log.Panic(err)
-		}
+		return txn.Set(block.Hash, block.Serialize())
+	}); err != nil {
+		log.Panic(err)
+	}
 
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
-			log.Panic(err)
-		}
-		lastHash, _ := item.ValueCopy(nil)
+	if known {
+		return false
+	}
 
-		item, err = txn.Get(lastHash)
-		if err != nil {
-			log.Panic(err)
-		}
-		lastBlockData, _ := item.ValueCopy(nil)
+	_, lastHeight := chain.lastBlockInfo()
+	if block.Height <= lastHeight {
+		return false
+	}
 
-		lastBlock := DeserializeBlock(lastBlockData)
+	if err := chain.setTip(block); err != nil {
+		fmt.Printf("Block %x is not connected: %s\n", block.Hash, err)
+		return false
+	}
+
+	return true
+}
 
-		if block.Height > lastBlock.Height {
-			if err := txn.Set([]byte("lh"), block.Hash); err != nil {
+func (chain *BlockChain) setTip(block *Block) error {
+	UTXOSet := UTXOSet{chain}
+
+	if err := UTXOSet.SyncTo(block); err != nil {
+		// reconnect the branch of the previous tip
+		if tip, tipErr := chain.getBlock(chain.LastHash); tipErr == nil {
+			if err := UTXOSet.SyncTo(tip); err != nil {
 				log.Panic(err)
 			}
-			chain.LastHash = block.Hash
 		}
+		return err
+	}
 
-		return nil
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("lh"), block.Hash)
 	}); err != nil {
 		log.Panic(err)
 	}
-}
+	chain.LastHash = block.Hash
 
-func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
-	var block Block
+	return nil
+}
 
-	if err := chain.Database.View(func(txn *badger.Txn) error {
-		if item, err := txn.Get(blockHash); err != nil {
-			return errors.New("block is not found")
-		} else {
-			blockData, _ := item.ValueCopy(nil)
+// getBlock returns a stored block, its transactions are missing once pruned
+func (chain *BlockChain) getBlock(blockHash []byte) (*Block, error) {
+	var block *Block
 
-			block = *DeserializeBlock(blockData)
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(blockHash)
+		if err != nil {
+			return fmt.Errorf("block %x is not found", blockHash)
 		}
+		blockData, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		block = DeserializeBlock(blockData)
 
 		return nil
-	}); err != nil {
-		return block, err
+	})
+
+	return block, err
+}
+
+func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
+	block, err := chain.getBlock(blockHash)
+	if err != nil {
+		return Block{}, errors.New("block is not found")
 	}
 
-	return block, nil
+	if block.IsPruned() {
+		return *block, errors.New("block body is pruned")
+	}
+
+	return *block, nil
+}
+
+func (chain *BlockChain) HasBlock(blockHash []byte) bool {
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(blockHash)
+		return err
+	})
+
+	return err == nil
 }
 
 func (chain *BlockChain) GetBlockHashes() [][]byte {
@@ -194,7 +246,7 @@ func (chain *BlockChain) GetBlockHashes() [][]byte {
 
 		blocks = append(blocks, block.Hash)
 
-		if len(block.PrevHash) == 0 {
+		if !iter.HasNext() {
 			break
 		}
 	}
@@ -228,7 +280,7 @@ func (chain *BlockChain) GetBestHeight() int {
 	return lastBlock.Height
 }
 
-func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
+func (chain *BlockChain) lastBlockInfo() ([]byte, int) {
 	var lastHash []byte
 	var lastHeight int
 
@@ -256,60 +308,79 @@ func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
 		log.Panic(err)
 	}
 
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+	return lastHash, lastHeight
+}
 
-	if err := chain.Database.Update(func(txn *badger.Txn) error {
-		if err := txn.Set(newBlock.Hash, newBlock.Serialize()); err != nil {
-			log.Panic(err)
+// NewBlockTemplate returns an unsealed block on top of the current tip, its
+// timestamp is after the median time past of the tip
+func (chain *BlockChain) NewBlockTemplate(transactions []*Transaction) *Block {
+	lastHash, lastHeight := chain.lastBlockInfo()
+
+	block := NewBlock(transactions, lastHash, lastHeight+1)
+	if tip, err := chain.getBlock(lastHash); err == nil {
+		if minTime := chain.MedianTimePast(tip) + 1; block.Timestamp < minTime {
+			block.Timestamp = minTime
 		}
-		err := txn.Set([]byte("lh"), newBlock.Hash)
+	}
 
-		chain.LastHash = newBlock.Hash
+	return block
+}
 
-		return err
+func (chain *BlockChain) MineBlock(transactions []*Transaction) (*Block, error) {
+	newBlock := chain.NewBlockTemplate(transactions)
+	if err := Engine.Seal(newBlock); err != nil {
+		return nil, err
+	}
+
+	for _, tx := range newBlock.Transactions {
+		if err := chain.CheckLocks(tx, newBlock.Height, newBlock.Timestamp); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(newBlock.Hash, newBlock.Serialize())
 	}); err != nil {
 		log.Panic(err)
 	}
 
-	return newBlock
+	if err := chain.setTip(newBlock); err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
 }
 
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
-	UTXO := make(map[string]TxOutputs)
-	spendTXOs := make(map[string][]int)
+func (chain *BlockChain) FindUTXO() map[Outpoint]UTXOEntry {
+	UTXO := make(map[Outpoint]UTXOEntry)
+	spentTXOs := make(map[Outpoint]bool)
 
 	iter := chain.Iterator()
 
 	for {
 		block := iter.Next()
 
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
+		// from the last transaction, a transaction can spend the outputs of
+		// the previous ones in the block
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			for outIdx, out := range tx.Outputs {
-				if spendTXOs[txID] != nil {
-					for _, spentOut := range spendTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
+				outpoint := NewOutpoint(tx.ID, outIdx)
+				if spentTXOs[outpoint] || IsUnspendable(out.ScriptPubKey) {
+					continue
 				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
+				UTXO[outpoint] = UTXOEntry{out, block.Height, tx.IsCoinbase(), block.Timestamp}
 			}
 
 			if tx.IsCoinbase() == false {
 				// find other outputs that are referenced by inputs
 				for _, in := range tx.Inputs {
-					inTxID := hex.EncodeToString(in.ID)
-					spendTXOs[inTxID] = append(spendTXOs[inTxID], in.Out)
+					spentTXOs[in.Outpoint()] = true
 				}
 			}
 		}
 
-		if len(block.PrevHash) == 0 {
+		if !iter.HasNext() {
 			break
 		}
 	}
@@ -329,7 +400,7 @@ func (chain *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 			}
 		}
 
-		if len(block.PrevHash) == 0 {
+		if !iter.HasNext() {
 			break
 		}
 	}
@@ -337,18 +408,111 @@ func (chain *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New("transaction does not exist")
 }
 
-func (chain *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
+// FindAnchor returns the block and the transaction carrying data in an
+// OP_RETURN output, the bodies of pruned blocks are not searched
+func (chain *BlockChain) FindAnchor(data []byte) (*Block, *Transaction, error) {
+	iter := chain.Iterator()
+
+	for {
+		block := iter.Next()
+
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Outputs {
+				if anchored, ok := ExtractData(out.ScriptPubKey); ok && bytes.Equal(anchored, data) {
+					return block, tx, nil
+				}
+			}
+		}
+
+		if !iter.HasNext() {
+			break
+		}
+	}
+
+	return nil, nil, errors.New("the data is not anchored in the chain")
+}
+
+// prevOutputs returns the outputs spent by tx, read from pending, the outputs
+// that are not confirmed yet, from the UTXO set or from the chain when they
+// are already spent
+func (chain *BlockChain) prevOutputs(tx *Transaction, pending map[Outpoint]TxOutput) (map[Outpoint]TxOutput, error) {
+	prevOuts := make(map[Outpoint]TxOutput)
+	UTXOSet := UTXOSet{chain}
 
 	for _, in := range tx.Inputs {
+		if out, ok := pending[in.Outpoint()]; ok {
+			prevOuts[in.Outpoint()] = out
+			continue
+		}
+		if entry, err := UTXOSet.GetEntry(in.Outpoint()); err == nil {
+			prevOuts[in.Outpoint()] = entry.Output
+			continue
+		}
+
 		prevTX, err := chain.FindTransaction(in.ID)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
+		}
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return nil, fmt.Errorf("output %d of transaction %x does not exist", in.Out, in.ID)
 		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		prevOuts[in.Outpoint()] = prevTX.Outputs[in.Out]
 	}
 
-	tx.Sign(privKey, prevTXs)
+	return prevOuts, nil
+}
+
+// branchOutputs returns the outputs created by the blocks between the main
+// chain and parentHash, they are missing from the UTXO set and FindTransaction
+// when parentHash is on a side branch
+func (chain *BlockChain) branchOutputs(parentHash []byte) (map[Outpoint]TxOutput, error) {
+	outputs := make(map[Outpoint]TxOutput)
+	if bytes.Equal(parentHash, chain.LastHash) {
+		return outputs, nil
+	}
+
+	branch, err := chain.getBlock(parentHash)
+	if err != nil {
+		return nil, err
+	}
+	main, err := chain.getBlock(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	for !bytes.Equal(branch.Hash, main.Hash) {
+		if main.Height > branch.Height {
+			if main, err = chain.getBlock(main.PrevHash); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if len(branch.PrevHash) == 0 {
+			return nil, errors.New("the blocks do not share the same genesis")
+		}
+		for _, tx := range branch.Transactions {
+			for outIdx, out := range tx.Outputs {
+				outputs[NewOutpoint(tx.ID, outIdx)] = out
+			}
+		}
+		if branch, err = chain.getBlock(branch.PrevHash); err != nil {
+			return nil, err
+		}
+	}
+
+	return outputs, nil
+}
+
+// SignTransaction signs tx, which may spend the outputs of the pending
+// transactions of our wallets
+func (chain *BlockChain) SignTransaction(tx *Transaction, w *wallet.Wallet) {
+	prevOuts, err := chain.prevOutputs(tx, chain.pendingWalletOutputs())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tx.Sign(w, prevOuts)
 }
 
 func (chain *BlockChain) VerifyTransaction(tx *Transaction) bool {
@@ -356,17 +520,64 @@ func (chain *BlockChain) VerifyTransaction(tx *Transaction) bool {
 		return true
 	}
 
-	prevTXs := make(map[string]Transaction)
+	prevOuts, err := chain.prevOutputs(tx, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return tx.Verify(prevOuts)
+}
 
-	for _, in := range tx.Inputs {
-		prevTX, err := chain.FindTransaction(in.ID)
-		if err != nil {
-			log.Panic(err)
+// ValidateBlock checks a block received from a peer: its header with the
+// consensus engine, the checkpoints and the signatures of its transactions,
+// which are skipped for the ancestors of the last checkpoint to speed up the
+// initial sync and below a loaded snapshot. A block below the checkpoint
+// height that is not linked to the checkpoint yet is fully checked.
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if err := Engine.VerifyHeader(block); err != nil {
+		return err
+	}
+
+	if err := chain.CheckTimestamp(block, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	if err := chain.CheckCheckpoint(block); err != nil {
+		return err
+	}
+
+	if chain.isCheckpointed(block) {
+		return nil
+	}
+
+	// the history below a loaded snapshot is checked by ValidateSnapshot
+	if snapshot, ok := chain.Snapshot(); ok && block.Height <= snapshot.Height {
+		return nil
+	}
+
+	// a transaction can spend the outputs of the previous ones in the block
+	// and of the side branch the block extends
+	created, err := chain.branchOutputs(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			prevOuts, err := chain.prevOutputs(tx, created)
+			if err != nil {
+				return err
+			}
+			if !tx.Verify(prevOuts) {
+				return fmt.Errorf("invalid signature in transaction %x", tx.ID)
+			}
+		}
+
+		for outIdx, out := range tx.Outputs {
+			created[NewOutpoint(tx.ID, outIdx)] = out
 		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	return tx.Verify(prevTXs)
+	return nil
 }
 
 func DeserializeTransaction(data []byte) Transaction {
@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// DustThreshold is the smallest change output, a lower change is left to the
+// miner as fee. It must be at least 1.
+var DustThreshold = 1
+
+// bnbMaxTries bounds the branches explored by the branch and bound selection
+const bnbMaxTries = 100000
+
+var errInsufficientFunds = errors.New("not enough funds")
+
+// Coin is an output that can be spent by a wallet
+type Coin struct {
+	Outpoint Outpoint
+	Value    int
+}
+
+// CoinSelector chooses the coins funding amount
+type CoinSelector interface {
+	Select(coins []Coin, amount int) ([]Coin, error)
+}
+
+// DefaultCoinSelector avoids the change when it can
+var DefaultCoinSelector CoinSelector = BranchAndBound{Fallback: LargestFirst{}}
+
+// CoinSelectors are the strategies by name
+var CoinSelectors = map[string]CoinSelector{
+	"bnb":      DefaultCoinSelector,
+	"largest":  LargestFirst{},
+	"smallest": SmallestFirst{},
+	"random":   RandomSelector{},
+}
+
+// BranchAndBound looks for the coins whose total is below amount plus
+// DustThreshold, so that the transaction has no change. Fallback is used when
+// there is no such match.
+type BranchAndBound struct {
+	Fallback CoinSelector
+}
+
+func (s BranchAndBound) Select(coins []Coin, amount int) ([]Coin, error) {
+	sorted := sortCoins(coins, true)
+
+	// remaining[i] is the total of the coins from i
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Value
+	}
+
+	selected := make([]bool, len(sorted))
+	tries := 0
+	var search func(i, total int) bool
+	search = func(i, total int) bool {
+		tries++
+		if total >= amount {
+			return total < amount+DustThreshold
+		}
+		if i == len(sorted) || total+remaining[i] < amount || tries > bnbMaxTries {
+			return false
+		}
+
+		selected[i] = true
+		if search(i+1, total+sorted[i].Value) {
+			return true
+		}
+		selected[i] = false
+
+		// excluding a coin after including one of the same value gives the
+		// same totals
+		next := i + 1
+		for next < len(sorted) && sorted[next].Value == sorted[i].Value {
+			next++
+		}
+		return search(next, total)
+	}
+
+	if search(0, 0) {
+		var selection []Coin
+		for i, coin := range sorted {
+			if selected[i] {
+				selection = append(selection, coin)
+			}
+		}
+		return selection, nil
+	}
+
+	if s.Fallback == nil {
+		return nil, errors.New("no selection without change")
+	}
+	return s.Fallback.Select(coins, amount)
+}
+
+// LargestFirst spends the fewest coins
+type LargestFirst struct{}
+
+func (LargestFirst) Select(coins []Coin, amount int) ([]Coin, error) {
+	return accumulateCoins(sortCoins(coins, true), amount)
+}
+
+// SmallestFirst consolidates the small coins
+type SmallestFirst struct{}
+
+func (SmallestFirst) Select(coins []Coin, amount int) ([]Coin, error) {
+	return accumulateCoins(sortCoins(coins, false), amount)
+}
+
+// RandomSelector does not reveal the order of the coins of the wallet
+type RandomSelector struct{}
+
+func (RandomSelector) Select(coins []Coin, amount int) ([]Coin, error) {
+	shuffled := append([]Coin{}, coins...)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	return accumulateCoins(shuffled, amount)
+}
+
+// sortCoins returns the coins by value, the ties are broken by outpoint
+func sortCoins(coins []Coin, descending bool) []Coin {
+	sorted := append([]Coin{}, coins...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Value != b.Value {
+			return (a.Value > b.Value) == descending
+		}
+		if a.Outpoint.ID != b.Outpoint.ID {
+			return a.Outpoint.ID < b.Outpoint.ID
+		}
+		return a.Outpoint.Index < b.Outpoint.Index
+	})
+
+	return sorted
+}
+
+// accumulateCoins takes the coins in order until their total reaches amount
+func accumulateCoins(coins []Coin, amount int) ([]Coin, error) {
+	var selection []Coin
+	total := 0
+	for _, coin := range coins {
+		if total >= amount {
+			break
+		}
+		selection = append(selection, coin)
+		total += coin.Value
+	}
+
+	if total < amount {
+		return nil, errInsufficientFunds
+	}
+
+	return selection, nil
+}
@@ -0,0 +1,334 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dgraph-io/badger"
+)
+
+// undo data of a block: the entries it spent, to restore them on disconnect
+var undoPrefix = []byte("undo-")
+
+type SpentEntry struct {
+	Outpoint Outpoint
+	Entry    UTXOEntry
+}
+
+func undoKey(blockHash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), blockHash...)
+}
+
+func serializeUndo(spent []SpentEntry) []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(spent); err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func deserializeUndo(data []byte) []SpentEntry {
+	var spent []SpentEntry
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&spent); err != nil {
+		log.Panic(err)
+	}
+	return spent
+}
+
+// checkBlock checks the transactions of block against the UTXO set read with
+// get: the locks, the spent outputs, the fees and the coinbase value. verify,
+// when set, checks each transaction with the outputs it spends. It returns the
+// entries spent by the block.
+func checkBlock(block *Block, get func(outpoint Outpoint) (UTXOEntry, bool, error), verify func(tx *Transaction, prevOuts map[Outpoint]TxOutput) error) ([]SpentEntry, error) {
+	var spent []SpentEntry
+	created := make(map[Outpoint]UTXOEntry)
+	spentSet := make(map[Outpoint]bool)
+	fees, coinbaseValue := 0, 0
+	for _, tx := range block.Transactions {
+		if !tx.IsFinal(block.Height, block.Timestamp) {
+			return nil, fmt.Errorf("transaction %x is locked until %d", tx.ID, tx.LockTime)
+		}
+		if err := tx.CheckSanity(); err != nil {
+			return nil, err
+		}
+
+		if tx.IsCoinbase() {
+			for _, out := range tx.Outputs {
+				coinbaseValue += out.Value
+			}
+		} else {
+			prevOuts := make(map[Outpoint]TxOutput)
+			for _, in := range tx.Inputs {
+				outpoint := in.Outpoint()
+				if spentSet[outpoint] {
+					return nil, fmt.Errorf("output %d of transaction %x is spent twice", in.Out, in.ID)
+				}
+
+				entry, ok := created[outpoint]
+				if !ok {
+					var err error
+					entry, ok, err = get(outpoint)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if !ok {
+					return nil, fmt.Errorf("output %d of transaction %x is not unspent", in.Out, in.ID)
+				}
+				if err := checkSequenceLock(in, entry, block.Height, block.Timestamp); err != nil {
+					return nil, err
+				}
+				spentSet[outpoint] = true
+				spent = append(spent, SpentEntry{outpoint, entry})
+				prevOuts[outpoint] = entry.Output
+			}
+
+			fee, err := tx.Fee(prevOuts)
+			if err != nil {
+				return nil, err
+			}
+			fees += fee
+
+			if verify != nil {
+				if err := verify(tx, prevOuts); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for outIdx, out := range tx.Outputs {
+			if !IsUnspendable(out.ScriptPubKey) {
+				created[NewOutpoint(tx.ID, outIdx)] = UTXOEntry{out, block.Height, tx.IsCoinbase(), block.Timestamp}
+			}
+		}
+	}
+
+	if coinbaseValue > Subsidy+fees {
+		return nil, fmt.Errorf("the coinbase claims %d, more than the subsidy and the fees %d", coinbaseValue, Subsidy+fees)
+	}
+
+	return spent, nil
+}
+
+// Connect applies a block on top of the UTXO tip in the cache, which is
+// flushed to the database once it exceeds UTXOCacheSize. The spent entries
+// are kept as undo data to disconnect the block on a reorganization.
+func (u UTXOSet) Connect(block *Block) error {
+	db := u.BlockChain.Database
+	cache := u.BlockChain.utxoCache
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.loadStats(db); err != nil {
+		return err
+	}
+
+	// check every input before touching the cache so that an invalid block
+	// leaves the set unchanged
+	spent, err := checkBlock(block, func(outpoint Outpoint) (UTXOEntry, bool, error) {
+		return cache.get(db, outpoint)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set(undoKey(block.Hash), serializeUndo(spent))
+	}); err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				outpoint := in.Outpoint()
+				entry, _, _ := cache.get(db, outpoint)
+				cache.spend(outpoint)
+				cache.stats.Remove(outpoint, entry)
+			}
+		}
+
+		for outIdx, out := range tx.Outputs {
+			if IsUnspendable(out.ScriptPubKey) {
+				continue
+			}
+			outpoint := NewOutpoint(tx.ID, outIdx)
+			entry := UTXOEntry{out, block.Height, tx.IsCoinbase(), block.Timestamp}
+			cache.add(outpoint, entry)
+			cache.stats.Add(outpoint, entry)
+		}
+	}
+	cache.tip = block.Hash
+
+	if cache.size > UTXOCacheSize {
+		return cache.flush(db)
+	}
+
+	return nil
+}
+
+// Disconnect reverts the UTXO tip block with its undo data
+func (u UTXOSet) Disconnect(block *Block) error {
+	db := u.BlockChain.Database
+
+	if !bytes.Equal(u.Tip(), block.Hash) {
+		return fmt.Errorf("block %x is not the UTXO tip", block.Hash)
+	}
+	if block.IsPruned() {
+		return fmt.Errorf("block %x is pruned", block.Hash)
+	}
+
+	var spent []SpentEntry
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(undoKey(block.Hash))
+		if err != nil {
+			return fmt.Errorf("no undo data for block %x: %w", block.Hash, err)
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		spent = deserializeUndo(v)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	cache := u.BlockChain.utxoCache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.loadStats(db); err != nil {
+		return err
+	}
+
+	inputs := 0
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			inputs += len(tx.Inputs)
+		}
+	}
+	if inputs != len(spent) {
+		return fmt.Errorf("the undo data does not match block %x", block.Hash)
+	}
+
+	// undo the transactions from the last one, an output created and spent in
+	// the block is restored by its spender before being removed
+	next := len(spent)
+	for t := len(block.Transactions) - 1; t >= 0; t-- {
+		tx := block.Transactions[t]
+		for outIdx, out := range tx.Outputs {
+			if IsUnspendable(out.ScriptPubKey) {
+				continue
+			}
+			outpoint := NewOutpoint(tx.ID, outIdx)
+			entry, ok, err := cache.get(db, outpoint)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("output %d of transaction %x is already spent", outIdx, tx.ID)
+			}
+			cache.spend(outpoint)
+			cache.stats.Remove(outpoint, entry)
+		}
+
+		if tx.IsCoinbase() == false {
+			for range tx.Inputs {
+				next--
+				cache.add(spent[next].Outpoint, spent[next].Entry)
+				cache.stats.Add(spent[next].Outpoint, spent[next].Entry)
+			}
+		}
+	}
+	cache.tip = block.PrevHash
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(undoKey(block.Hash))
+	}); err != nil {
+		return err
+	}
+
+	if cache.size > UTXOCacheSize {
+		return cache.flush(db)
+	}
+
+	return nil
+}
+
+// SyncTo moves the UTXO tip to target, disconnecting the blocks of the
+// current branch down to the fork point then connecting the new branch
+func (u UTXOSet) SyncTo(target *Block) error {
+	chain := u.BlockChain
+
+	var disconnect, connect []*Block
+
+	newBranch := target
+	tipHash := u.Tip()
+	if len(tipHash) > 0 {
+		oldBranch, err := chain.getBlock(tipHash)
+		if err != nil {
+			return err
+		}
+
+		for oldBranch.Height > newBranch.Height {
+			disconnect = append(disconnect, oldBranch)
+			if oldBranch, err = chain.getBlock(oldBranch.PrevHash); err != nil {
+				return err
+			}
+		}
+		for newBranch.Height > oldBranch.Height {
+			connect = append(connect, newBranch)
+			if newBranch, err = chain.getBlock(newBranch.PrevHash); err != nil {
+				return err
+			}
+		}
+		for !bytes.Equal(oldBranch.Hash, newBranch.Hash) {
+			if len(oldBranch.PrevHash) == 0 {
+				return errors.New("the blocks do not share the same genesis")
+			}
+			disconnect = append(disconnect, oldBranch)
+			connect = append(connect, newBranch)
+			if oldBranch, err = chain.getBlock(oldBranch.PrevHash); err != nil {
+				return err
+			}
+			if newBranch, err = chain.getBlock(newBranch.PrevHash); err != nil {
+				return err
+			}
+		}
+	} else {
+		for {
+			connect = append(connect, newBranch)
+			if len(newBranch.PrevHash) == 0 {
+				break
+			}
+			var err error
+			if newBranch, err = chain.getBlock(newBranch.PrevHash); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, block := range disconnect {
+		if err := u.Disconnect(block); err != nil {
+			return err
+		}
+	}
+
+	for i := len(connect) - 1; i >= 0; i-- {
+		if connect[i].IsPruned() {
+			return fmt.Errorf("block %x is pruned", connect[i].Hash)
+		}
+		if err := u.Connect(connect[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
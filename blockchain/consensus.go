@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ConsensusEngine seals the blocks created by this node and checks the
+// headers of the blocks received from peers
+type ConsensusEngine interface {
+	Seal(block *Block) error
+	VerifyHeader(block *Block) error
+	CalcDifficulty(parent *Block) int
+}
+
+const (
+	// the timestamp of a block is after the median of the timestamps of this
+	// many blocks before it
+	medianTimeBlocks = 11
+	// MaxFutureBlockTime bounds in seconds how far the timestamp of a block
+	// is ahead of the clock
+	MaxFutureBlockTime = 2 * 60 * 60
+)
+
+// Engine is the consensus engine used to create and verify blocks
+var Engine ConsensusEngine = &PowEngine{}
+
+type PowEngine struct{}
+
+func (e *PowEngine) Seal(block *Block) error {
+	pow := NewProof(block)
+	nonce, hash := pow.Run()
+
+	block.Hash = hash[:]
+	block.Nonce = nonce
+
+	return nil
+}
+
+func (e *PowEngine) VerifyHeader(block *Block) error {
+	pow := NewProof(block)
+	if !pow.Validate() {
+		return errors.New("invalid proof of work")
+	}
+
+	hash := sha256.Sum256(pow.InitData(block.Nonce))
+	if !bytes.Equal(hash[:], block.Hash) {
+		return errors.New("block hash does not match its header")
+	}
+
+	return nil
+}
+
+func (e *PowEngine) CalcDifficulty(parent *Block) int {
+	return Difficulty
+}
+
+// MedianTimePast returns the median timestamp of block and its ancestors, up
+// to medianTimeBlocks blocks
+func (chain *BlockChain) MedianTimePast(block *Block) int64 {
+	var timestamps []int64
+	for len(timestamps) < medianTimeBlocks {
+		timestamps = append(timestamps, block.Timestamp)
+
+		parent, err := chain.getBlock(block.PrevHash)
+		if len(block.PrevHash) == 0 || err != nil {
+			break
+		}
+		block = parent
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
+// CheckTimestamp rejects a block whose timestamp is not after the median time
+// past of its parent or is more than MaxFutureBlockTime ahead of now, the
+// time locks of its transactions depend on it
+func (chain *BlockChain) CheckTimestamp(block *Block, now int64) error {
+	if block.Timestamp > now+MaxFutureBlockTime {
+		return fmt.Errorf("the timestamp of block %x is too far in the future", block.Hash)
+	}
+	if len(block.PrevHash) == 0 {
+		return nil
+	}
+
+	parent, err := chain.getBlock(block.PrevHash)
+	if err != nil {
+		return fmt.Errorf("the parent of block %x is unknown", block.Hash)
+	}
+	if block.Timestamp <= chain.MedianTimePast(parent) {
+		return fmt.Errorf("the timestamp of block %x is not after the median time past of its parent", block.Hash)
+	}
+
+	return nil
+}
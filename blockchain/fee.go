@@ -0,0 +1,119 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/nclv/golang-blockchain/wallet"
+)
+
+// Subsidy is created by the coinbase of every block, the miner also collects
+// the fees of the block transactions
+const Subsidy = 20
+
+// Size returns the serialized size of tx in bytes
+func (tx *Transaction) Size() int {
+	return len(tx.Serialize())
+}
+
+// FeeRate returns the fee per 1000 bytes of a transaction
+func FeeRate(fee, size int) int {
+	if size == 0 {
+		return 0
+	}
+	return fee * 1000 / size
+}
+
+// Fee returns the value of the outputs spent by tx that is not sent to its
+// outputs
+func (tx *Transaction) Fee(prevOuts map[Outpoint]TxOutput) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	in := 0
+	for _, input := range tx.Inputs {
+		prevOut, ok := prevOuts[input.Outpoint()]
+		if !ok {
+			return 0, fmt.Errorf("output %d of transaction %x does not exist", input.Out, input.ID)
+		}
+		in += prevOut.Value
+	}
+
+	out := 0
+	for _, output := range tx.Outputs {
+		out += output.Value
+	}
+
+	if out > in {
+		return 0, fmt.Errorf("transaction %x sends %d but spends %d", tx.ID, out, in)
+	}
+
+	return in - out, nil
+}
+
+// TransactionFee returns the fee of a transaction spending confirmed outputs or
+// the outputs of the pending transactions of our wallets
+func (chain *BlockChain) TransactionFee(tx *Transaction) (int, error) {
+	prevOuts, err := chain.prevOutputs(tx, chain.pendingWalletOutputs())
+	if err != nil {
+		return 0, err
+	}
+
+	return tx.Fee(prevOuts)
+}
+
+// BumpFee rebuilds the unconfirmed tx sent by w with fee, the difference with
+// its current fee is taken from the change. The inputs are the same so that
+// the new transaction replaces tx in the memory pools.
+func BumpFee(w *wallet.Wallet, tx *Transaction, fee int, UTXO *UTXOSet) (*Transaction, error) {
+	prevOuts, err := UTXO.BlockChain.prevOutputs(tx, UTXO.BlockChain.pendingWalletOutputs())
+	if err != nil {
+		return nil, err
+	}
+	oldFee, err := tx.Fee(prevOuts)
+	if err != nil {
+		return nil, err
+	}
+	if fee <= oldFee {
+		return nil, fmt.Errorf("the new fee must be higher than %d", oldFee)
+	}
+
+	changeScript := P2PKHScript(wallet.PublicKeyHash(w.PublicKey))
+	for _, prevOut := range prevOuts {
+		if !bytes.Equal(prevOut.ScriptPubKey, changeScript) {
+			return nil, errors.New("only the transactions spending the outputs of the wallet can be bumped")
+		}
+	}
+
+	change := -1
+	for outIdx, out := range tx.Outputs {
+		if bytes.Equal(out.ScriptPubKey, changeScript) {
+			change = outIdx
+		}
+	}
+	if change < 0 {
+		return nil, errors.New("the transaction has no change to pay the fee")
+	}
+
+	outputs := append([]TxOutput{}, tx.Outputs...)
+	outputs[change].Value -= fee - oldFee
+	if outputs[change].Value < 0 {
+		return nil, fmt.Errorf("the change of %d cannot pay the fee", tx.Outputs[change].Value)
+	}
+	if outputs[change].Value == 0 || outputs[change].Value < DustThreshold {
+		outputs = append(outputs[:change], outputs[change+1:]...)
+	}
+
+	var inputs []TxInput
+	for _, in := range tx.Inputs {
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, in.Sequence})
+	}
+
+	newTx := Transaction{nil, inputs, outputs, tx.LockTime}
+	newTx.ID = newTx.Hash()
+	UTXO.BlockChain.SignTransaction(&newTx, w)
+
+	return &newTx, nil
+}
@@ -0,0 +1,168 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+
+	"github.com/dgraph-io/badger"
+)
+
+// confirmation delays of the transactions of the memory pool by fee rate
+var feeStatsKey = []byte("feestats")
+
+const (
+	// MaxConfirmTarget is the longest confirmation delay tracked in blocks
+	MaxConfirmTarget = 25
+	// feeStatsDecay weights down the transactions of the older blocks
+	feeStatsDecay = 0.998
+	// an estimate needs this many transactions in the fee rate buckets
+	minEstimateSamples = 10
+	// share of the transactions confirmed within the target
+	estimateSuccess = 0.85
+)
+
+// FallbackFeeRate is estimated when too few transactions were confirmed
+var FallbackFeeRate = 1
+
+// FeeBuckets are the lowest fee rates of the buckets
+var FeeBuckets = []int{0, 1, 2, 3, 5, 8, 13, 20, 30, 50, 75, 100, 150, 250, 500, 1000}
+
+// FeeStats counts the transactions of each fee rate bucket by number of blocks
+// they waited before their confirmation
+type FeeStats struct {
+	// Confirmed[bucket][t] counts the transactions confirmed within t+1 blocks
+	Confirmed [][]float64
+	Total     []float64
+}
+
+type FeeEstimate struct {
+	Blocks   int  `json:"blocks"`
+	FeeRate  int  `json:"fee_rate"`
+	Fallback bool `json:"fallback"`
+}
+
+func NewFeeStats() *FeeStats {
+	stats := &FeeStats{
+		Confirmed: make([][]float64, len(FeeBuckets)),
+		Total:     make([]float64, len(FeeBuckets)),
+	}
+	for bucket := range stats.Confirmed {
+		stats.Confirmed[bucket] = make([]float64, MaxConfirmTarget)
+	}
+
+	return stats
+}
+
+func feeBucket(feeRate int) int {
+	bucket := 0
+	for i, lowest := range FeeBuckets {
+		if feeRate >= lowest {
+			bucket = i
+		}
+	}
+
+	return bucket
+}
+
+// Decay weights down the counts, it is called once per block
+func (s *FeeStats) Decay() {
+	for bucket := range s.Total {
+		s.Total[bucket] *= feeStatsDecay
+		for t := range s.Confirmed[bucket] {
+			s.Confirmed[bucket][t] *= feeStatsDecay
+		}
+	}
+}
+
+// Record counts a transaction paying feeRate confirmed after blocks blocks
+func (s *FeeStats) Record(feeRate, blocks int) {
+	if blocks < 1 {
+		blocks = 1
+	}
+
+	bucket := feeBucket(feeRate)
+	s.Total[bucket]++
+	for t := blocks - 1; t < MaxConfirmTarget; t++ {
+		s.Confirmed[bucket][t]++
+	}
+}
+
+// Estimate returns the lowest fee rate whose transactions, and the ones of
+// the higher buckets, were confirmed within blocks blocks
+func (s *FeeStats) Estimate(blocks int) FeeEstimate {
+	if blocks < 1 {
+		blocks = 1
+	}
+	if blocks > MaxConfirmTarget {
+		blocks = MaxConfirmTarget
+	}
+
+	estimate := FeeEstimate{Blocks: blocks, FeeRate: FallbackFeeRate, Fallback: true}
+
+	// the buckets are grouped from the highest until the group has enough
+	// transactions
+	confirmed, total := 0.0, 0.0
+	for bucket := len(FeeBuckets) - 1; bucket >= 0; bucket-- {
+		confirmed += s.Confirmed[bucket][blocks-1]
+		total += s.Total[bucket]
+		if total < minEstimateSamples {
+			continue
+		}
+		if confirmed/total < estimateSuccess {
+			break
+		}
+
+		estimate.FeeRate = FeeBuckets[bucket]
+		estimate.Fallback = false
+		confirmed, total = 0, 0
+	}
+
+	return estimate
+}
+
+// FeeStats returns the fee statistics saved by the node
+func (chain *BlockChain) FeeStats() *FeeStats {
+	stats := NewFeeStats()
+
+	if err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(feeStatsKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		var saved FeeStats
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&saved); err != nil {
+			return err
+		}
+		// the buckets changed, the statistics are started over
+		if len(saved.Total) == len(FeeBuckets) && len(saved.Confirmed[0]) == MaxConfirmTarget {
+			stats = &saved
+		}
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	return stats
+}
+
+func (chain *BlockChain) SaveFeeStats(stats *FeeStats) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(stats); err != nil {
+		log.Panic(err)
+	}
+
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(feeStatsKey, buffer.Bytes())
+	}); err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,232 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/nclv/golang-blockchain/wallet"
+)
+
+// HTLC is a hash time-locked contract: the recipient spends the outputs with
+// the secret hashed to Hash, or the sender takes them back once LockTime is
+// reached. The outputs are locked to the pay to script hash address of its
+// script:
+//
+//	OP_IF
+//	    OP_SHA256 <hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipient>
+//	OP_ELSE
+//	    <lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <sender>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+type HTLC struct {
+	Hash []byte
+	// public key hashes
+	Recipient []byte
+	Sender    []byte
+	// block height or unix time
+	LockTime int64
+}
+
+// NewHTLC locks outputs to the recipient address until lockTime, the sender
+// address is refunded after it
+func NewHTLC(hash []byte, recipient, sender string, lockTime int64) (HTLC, error) {
+	if len(hash) != sha256.Size {
+		return HTLC{}, fmt.Errorf("the hash must be %d bytes", sha256.Size)
+	}
+	if lockTime <= 0 {
+		return HTLC{}, errors.New("the lock time must be positive")
+	}
+
+	pubKeyHash := func(address string) ([]byte, error) {
+		version, payload, err := wallet.DecodeAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		if version != wallet.PubKeyHashVersion {
+			return nil, fmt.Errorf("%s is not a public key hash address", address)
+		}
+		return payload, nil
+	}
+
+	recipientHash, err := pubKeyHash(recipient)
+	if err != nil {
+		return HTLC{}, err
+	}
+	senderHash, err := pubKeyHash(sender)
+	if err != nil {
+		return HTLC{}, err
+	}
+
+	return HTLC{hash, recipientHash, senderHash, lockTime}, nil
+}
+
+func (h HTLC) Script() []byte {
+	script := []byte{OP_IF, OP_SHA256}
+	script = pushData(script, h.Hash)
+	script = append(script, OP_EQUALVERIFY, OP_DUP, OP_HASH160)
+	script = pushData(script, h.Recipient)
+	script = append(script, OP_ELSE)
+	script = pushNumber(script, h.LockTime)
+	script = append(script, OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_DUP, OP_HASH160)
+	script = pushData(script, h.Sender)
+
+	return append(script, OP_ENDIF, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// Address returns the pay to script hash address of the contract
+func (h HTLC) Address() (string, error) {
+	return ScriptHashAddress(h.Script())
+}
+
+// ExtractHTLC returns the contract of an HTLC script
+func ExtractHTLC(script []byte) (HTLC, bool) {
+	// the pushes are checked below
+	opcodes := []byte{OP_IF, OP_SHA256, 0, OP_EQUALVERIFY, OP_DUP, OP_HASH160, 0, OP_ELSE,
+		0, OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_DUP, OP_HASH160, 0, OP_ENDIF, OP_EQUALVERIFY, OP_CHECKSIG}
+
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) != len(opcodes) {
+		return HTLC{}, false
+	}
+	for i, op := range ops {
+		if opcodes[i] != 0 && op.Opcode != opcodes[i] {
+			return HTLC{}, false
+		}
+	}
+
+	hash, recipient, lockTime, sender := ops[2], ops[6], ops[8], ops[13]
+	if !hash.IsPush() || len(hash.Data) != sha256.Size || !recipient.IsPush() || len(recipient.Data) != 20 ||
+		!sender.IsPush() || len(sender.Data) != 20 || !lockTime.IsPush() {
+		return HTLC{}, false
+	}
+
+	h := HTLC{hash.Data, recipient.Data, sender.Data, 0}
+	if lockTime.Opcode >= OP_1 {
+		h.LockTime = int64(lockTime.Opcode-OP_1) + 1
+	} else if h.LockTime, err = scriptNumber(lockTime.Data, 5); err != nil {
+		return HTLC{}, false
+	}
+
+	return h, h.LockTime > 0
+}
+
+// NewHTLCClaim spends the outputs of the contract to the recipient with the
+// secret
+func NewHTLCClaim(w *wallet.Wallet, redeemScript, secret []byte, UTXO *UTXOSet) (*Transaction, error) {
+	h, ok := ExtractHTLC(redeemScript)
+	if !ok {
+		return nil, errors.New("not an HTLC script")
+	}
+	if hash := sha256.Sum256(secret); !bytes.Equal(hash[:], h.Hash) {
+		return nil, errors.New("the secret does not match the hash of the contract")
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(w.PublicKey), h.Recipient) {
+		return nil, errors.New("the wallet is not the recipient of the contract")
+	}
+
+	return spendHTLC(w, redeemScript, 0, func(scriptSig []byte) []byte {
+		return append(pushData(scriptSig, secret), OP_1)
+	}, UTXO)
+}
+
+// NewHTLCRefund spends the outputs of the contract back to the sender, the
+// transaction cannot be mined before the lock time of the contract
+func NewHTLCRefund(w *wallet.Wallet, redeemScript []byte, UTXO *UTXOSet) (*Transaction, error) {
+	h, ok := ExtractHTLC(redeemScript)
+	if !ok {
+		return nil, errors.New("not an HTLC script")
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(w.PublicKey), h.Sender) {
+		return nil, errors.New("the wallet is not the sender of the contract")
+	}
+
+	return spendHTLC(w, redeemScript, h.LockTime, func(scriptSig []byte) []byte {
+		return append(scriptSig, OP_0)
+	}, UTXO)
+}
+
+// spendHTLC sends every output of the contract to w, branch appends the
+// selector of the spent branch to the signature and the public key
+func spendHTLC(w *wallet.Wallet, redeemScript []byte, lockTime int64, branch func([]byte) []byte, UTXO *UTXOSet) (*Transaction, error) {
+	lockingScript := P2SHScript(wallet.PublicKeyHash(redeemScript))
+
+	// the lock time is only enforced if an input is not final
+	sequence := SequenceFinal
+	if lockTime != 0 {
+		sequence = SequenceFinal - 1
+	}
+
+	var inputs []TxInput
+	amount := 0
+	var err error
+	UTXO.ForEach(func(outpoint Outpoint, entry UTXOEntry) {
+		if err != nil || !bytes.Equal(entry.Output.ScriptPubKey, lockingScript) {
+			return
+		}
+		var txID []byte
+		if txID, err = hex.DecodeString(outpoint.ID); err == nil {
+			inputs = append(inputs, TxInput{txID, outpoint.Index, nil, sequence})
+			amount += entry.Output.Value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(inputs) == 0 {
+		return nil, errors.New("no unspent output is locked by the contract")
+	}
+
+	outputs := []TxOutput{*NewTXOutput(amount, string(w.Address()))}
+
+	tx := Transaction{nil, inputs, outputs, lockTime}
+	tx.ID = tx.Hash()
+
+	for inId := range tx.Inputs {
+		signature, err := tx.InputSignature(inId, redeemScript, w.PrivateKey, SigHashAll)
+		if err != nil {
+			return nil, err
+		}
+
+		scriptSig := branch(P2PKHScriptSig(signature, w.PublicKey))
+		tx.Inputs[inId].ScriptSig = pushData(scriptSig, redeemScript)
+	}
+
+	return &tx, nil
+}
+
+// FindHTLCSecret looks for a claim of the contract in the chain and returns
+// the secret it revealed
+func (chain *BlockChain) FindHTLCSecret(redeemScript []byte) ([]byte, error) {
+	h, ok := ExtractHTLC(redeemScript)
+	if !ok {
+		return nil, errors.New("not an HTLC script")
+	}
+
+	iter := chain.Iterator()
+
+	for {
+		block := iter.Next()
+
+		for _, tx := range block.Transactions {
+			for _, in := range tx.Inputs {
+				// <signature> <public key> <secret> OP_1 <redeem script>
+				ops, err := ParseScript(in.ScriptSig)
+				if err != nil || len(ops) != 5 || !bytes.Equal(ops[4].Data, redeemScript) {
+					continue
+				}
+				if hash := sha256.Sum256(ops[2].Data); bytes.Equal(hash[:], h.Hash) {
+					return ops[2].Data, nil
+				}
+			}
+		}
+
+		if !iter.HasNext() {
+			break
+		}
+	}
+
+	return nil, errors.New("the contract has not been claimed")
+}
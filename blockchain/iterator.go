@@ -38,3 +38,18 @@ func (iter *Iterator) Next() *Block {
 
 	return block
 }
+
+// HasNext tells whether the previous block is stored, the history below a
+// loaded UTXO snapshot may not be downloaded yet
+func (iter *Iterator) HasNext() bool {
+	if len(iter.CurrentHash) == 0 {
+		return false
+	}
+
+	err := iter.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(iter.CurrentHash)
+		return err
+	})
+
+	return err == nil
+}
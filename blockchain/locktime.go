@@ -0,0 +1,92 @@
+package blockchain
+
+import (
+	"fmt"
+)
+
+const (
+	// a lock time below is a block height, above a unix timestamp
+	LockTimeThreshold = 500000000
+
+	// an input with this sequence has no relative lock, the lock time of the
+	// transaction is ignored when all its inputs have it
+	SequenceFinal uint32 = 0xffffffff
+	// the relative lock of an input is disabled with this flag
+	SequenceLockTimeDisabled uint32 = 1 << 31
+	// the relative lock is counted in units of 512 seconds instead of blocks
+	SequenceLockTimeIsSeconds   uint32 = 1 << 22
+	SequenceLockTimeMask        uint32 = 0x0000ffff
+	SequenceLockTimeGranularity        = 9
+)
+
+// IsFinal tells whether tx can be included in a block at height with blockTime
+func (tx *Transaction) IsFinal(height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	limit := int64(height)
+	if tx.LockTime >= LockTimeThreshold {
+		limit = blockTime
+	}
+	if tx.LockTime < limit {
+		return true
+	}
+
+	for _, in := range tx.Inputs {
+		if in.Sequence != SequenceFinal {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkSequenceLock checks the relative lock of in, which spends entry, in a
+// block at height with blockTime
+func checkSequenceLock(in TxInput, entry UTXOEntry, height int, blockTime int64) error {
+	if in.Sequence&SequenceLockTimeDisabled != 0 {
+		return nil
+	}
+
+	value := int64(in.Sequence & SequenceLockTimeMask)
+	if in.Sequence&SequenceLockTimeIsSeconds != 0 {
+		unlockTime := entry.Time + value<<SequenceLockTimeGranularity
+		if blockTime < unlockTime {
+			return fmt.Errorf("output %d of transaction %x is locked until %d", in.Out, in.ID, unlockTime)
+		}
+		return nil
+	}
+
+	unlockHeight := entry.Height + int(value)
+	if height < unlockHeight {
+		return fmt.Errorf("output %d of transaction %x is locked until block %d", in.Out, in.ID, unlockHeight)
+	}
+
+	return nil
+}
+
+// CheckLocks checks the lock time and the relative locks of tx for a block
+// at height with blockTime. The relative locks of the inputs spending outputs
+// that are not in the UTXO set yet are checked when the block is connected.
+func (chain *BlockChain) CheckLocks(tx *Transaction, height int, blockTime int64) error {
+	if !tx.IsFinal(height, blockTime) {
+		return fmt.Errorf("transaction %x is locked until %d", tx.ID, tx.LockTime)
+	}
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	UTXOSet := UTXOSet{chain}
+	for _, in := range tx.Inputs {
+		entry, err := UTXOSet.GetEntry(in.Outpoint())
+		if err != nil {
+			continue
+		}
+		if err := checkSequenceLock(in, entry, height, blockTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"math"
+	"math/big"
+	"sync/atomic"
+	"time"
+)
+
+// last hashrate measured by ProofOfWork.Run or from the blocks of the external
+// miners, stored as float64 bits
+var localHashrate uint64
+
+type MiningInfo struct {
+	Height          int     `json:"height"`
+	Difficulty      int     `json:"difficulty"`
+	Target          string  `json:"target"`
+	Blocks          int     `json:"blocks"`
+	AvgInterval     float64 `json:"avg_interval"`
+	NetworkHashrate float64 `json:"network_hashrate"`
+	Mining          bool    `json:"mining"`
+	LocalHashrate   float64 `json:"local_hashrate"`
+}
+
+func recordHashrate(hashes float64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	rate := hashes / elapsed.Seconds()
+	atomic.StoreUint64(&localHashrate, math.Float64bits(rate))
+}
+
+// RecordBlockWork records the hashrate of the external miners that sealed
+// block after elapsed, from the expected number of hashes of its target
+func RecordBlockWork(block *Block, elapsed time.Duration) {
+	work, _ := new(big.Float).SetInt(BlockWork(NewProof(block).Target)).Float64()
+	recordHashrate(work, elapsed)
+}
+
+// LocalHashrate is the hashrate of the last block mined by this node, in
+// process or by its external miners
+func LocalHashrate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&localHashrate))
+}
+
+// BlockWork is the expected number of hashes to find a block, 2^256 / (target + 1)
+func BlockWork(target *big.Int) *big.Int {
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	return work.Div(work, denominator)
+}
+
+// MiningInfo estimates the network hashrate and the average block interval
+// from the timestamps of the last blocks blocks
+func (chain *BlockChain) MiningInfo(blocks int) MiningInfo {
+	iter := chain.Iterator()
+	tip := iter.Next()
+	target := NewProof(tip).Target
+
+	info := MiningInfo{
+		Height:        tip.Height,
+		Difficulty:    Engine.CalcDifficulty(tip),
+		Target:        target.Text(16),
+		LocalHashrate: LocalHashrate(),
+	}
+
+	totalWork := new(big.Int)
+	first := tip
+	for info.Blocks < blocks && iter.HasNext() {
+		totalWork.Add(totalWork, BlockWork(NewProof(first).Target))
+		first = iter.Next()
+		info.Blocks++
+	}
+
+	timespan := tip.Timestamp - first.Timestamp
+	if info.Blocks == 0 || timespan <= 0 {
+		return info
+	}
+
+	info.AvgInterval = float64(timespan) / float64(info.Blocks)
+	hashrate, _ := new(big.Float).Quo(new(big.Float).SetInt(totalWork), big.NewFloat(float64(timespan))).Float64()
+	info.NetworkHashrate = hashrate
+
+	return info
+}
@@ -0,0 +1,243 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nclv/golang-blockchain/wallet"
+)
+
+// MultisigScript locks an output to m signatures of the n public keys:
+// M <pubkey>... N OP_CHECKMULTISIG. It is refused when it is too long to be
+// the redeem script of a pay to script hash address.
+func MultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > MaxMultisigKeys {
+		return nil, fmt.Errorf("a multisig script needs 1 to %d public keys", MaxMultisigKeys)
+	}
+	if m < 1 || m > len(pubKeys) {
+		return nil, fmt.Errorf("the required signatures must be between 1 and %d", len(pubKeys))
+	}
+
+	script := []byte{smallInt(m)}
+	for _, pubKey := range pubKeys {
+		script = pushData(script, pubKey)
+	}
+	script = append(script, smallInt(len(pubKeys)), OP_CHECKMULTISIG)
+
+	if len(script) > MaxScriptElementSize {
+		return nil, fmt.Errorf("the multisig script of %d public keys exceeds %d bytes", len(pubKeys), MaxScriptElementSize)
+	}
+
+	return script, nil
+}
+
+// ExtractMultisig returns the required signatures and the public keys of a
+// multisig script
+func ExtractMultisig(script []byte) (int, [][]byte, bool) {
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].Opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	isSmallInt := func(op ScriptOp) bool {
+		return op.Opcode >= OP_1 && op.Opcode <= OP_16
+	}
+	first, last := ops[0], ops[len(ops)-2]
+	if !isSmallInt(first) || !isSmallInt(last) {
+		return 0, nil, false
+	}
+	m := int(first.Opcode-OP_1) + 1
+	n := int(last.Opcode-OP_1) + 1
+	if n != len(ops)-3 || m > n {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if !op.IsPush() || len(op.Data) == 0 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.Data)
+	}
+
+	return m, pubKeys, true
+}
+
+// MultisigScriptSig pushes the signatures in the order of their public keys
+func MultisigScriptSig(signatures [][]byte) []byte {
+	var script []byte
+	for _, signature := range signatures {
+		script = pushData(script, signature)
+	}
+
+	return script
+}
+
+// MultisigAddress returns the address of the outputs locked by a multisig script
+func MultisigAddress(script []byte) string {
+	return string(wallet.EncodeAddress(wallet.MultisigVersion, script))
+}
+
+// MultisigTx is a transaction spending multisig outputs whose signatures are
+// collected from the wallets of the members before it is broadcast
+type MultisigTx struct {
+	Tx Transaction
+	// the multisig script, the redeem script of a pay to script hash address
+	Script []byte
+	// locking script of the spent outputs
+	LockingScript []byte
+	// for each input, the signatures by public key index
+	Signatures []map[int][]byte
+}
+
+// NewMultisigTransaction spends from a multisig address, redeemScript is the
+// multisig script of a pay to script hash address
+func NewMultisigTransaction(from, to string, amount int, redeemScript []byte, UTXO *UTXOSet) *MultisigTx {
+	lockingScript, err := LockingScript(from)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	script := lockingScript
+	if scriptHash, ok := ExtractScriptHash(lockingScript); ok {
+		if !bytes.Equal(wallet.PublicKeyHash(redeemScript), scriptHash) {
+			log.Panic("Error: the redeem script does not match the address")
+		}
+		script = redeemScript
+	}
+	if _, _, ok := ExtractMultisig(script); !ok {
+		log.Panic("Error: not a multisig address")
+	}
+
+	acc, validOutputs := UTXO.FindSpendableScriptOutputs(lockingScript, amount)
+	if acc < amount {
+		log.Panic("Error: not enough funds")
+	}
+
+	var inputs []TxInput
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		for _, out := range outs {
+			inputs = append(inputs, TxInput{txID, out, nil, SequenceFinal})
+		}
+	}
+
+	outputs := []TxOutput{*NewTXOutput(amount, to)}
+	if acc > amount {
+		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	}
+
+	tx := Transaction{nil, inputs, outputs, 0}
+	tx.ID = tx.Hash()
+
+	return &MultisigTx{tx, script, lockingScript, make([]map[int][]byte, len(inputs))}
+}
+
+// Sign adds the signatures of w to every input
+func (mtx *MultisigTx) Sign(w *wallet.Wallet) error {
+	_, pubKeys, _ := ExtractMultisig(mtx.Script)
+	pubKey := w.PublicKey
+
+	keyIndex := -1
+	for i, key := range pubKeys {
+		if bytes.Equal(key, pubKey) {
+			keyIndex = i
+		}
+	}
+	if keyIndex < 0 {
+		return errors.New("the key is not a member of the multisig script")
+	}
+
+	for inId := range mtx.Tx.Inputs {
+		signature, err := mtx.Tx.InputSignature(inId, mtx.Script, w.PrivateKey, SigHashAll)
+		if err != nil {
+			return err
+		}
+
+		if mtx.Signatures[inId] == nil {
+			mtx.Signatures[inId] = make(map[int][]byte)
+		}
+		mtx.Signatures[inId][keyIndex] = signature
+	}
+
+	return nil
+}
+
+// Missing returns the number of signatures still needed
+func (mtx *MultisigTx) Missing() int {
+	m, _, _ := ExtractMultisig(mtx.Script)
+
+	missing := 0
+	for _, signatures := range mtx.Signatures {
+		if len(signatures) < m && m-len(signatures) > missing {
+			missing = m - len(signatures)
+		}
+	}
+
+	return missing
+}
+
+// Finalize builds the unlocking scripts once enough signatures are collected
+func (mtx *MultisigTx) Finalize() (*Transaction, error) {
+	if missing := mtx.Missing(); missing > 0 {
+		return nil, fmt.Errorf("%d signatures are missing", missing)
+	}
+
+	m, pubKeys, _ := ExtractMultisig(mtx.Script)
+
+	tx := mtx.Tx
+	tx.Inputs = append([]TxInput{}, mtx.Tx.Inputs...)
+	for inId := range tx.Inputs {
+		var signatures [][]byte
+		for keyIndex := range pubKeys {
+			if signature, ok := mtx.Signatures[inId][keyIndex]; ok && len(signatures) < m {
+				signatures = append(signatures, signature)
+			}
+		}
+		tx.Inputs[inId].ScriptSig = MultisigScriptSig(signatures)
+		if !bytes.Equal(mtx.LockingScript, mtx.Script) {
+			tx.Inputs[inId].ScriptSig = pushData(tx.Inputs[inId].ScriptSig, mtx.Script)
+		}
+	}
+	// the ID of the combined transaction is not trusted
+	tx.ID = transactionID(&tx)
+
+	prevOuts := make(map[Outpoint]TxOutput)
+	for _, in := range tx.Inputs {
+		prevOuts[in.Outpoint()] = TxOutput{ScriptPubKey: mtx.LockingScript}
+	}
+	if !tx.Verify(prevOuts) {
+		return nil, errors.New("the collected signatures do not unlock the outputs")
+	}
+
+	return &tx, nil
+}
+
+func (mtx *MultisigTx) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(mtx); err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeMultisigTx(data []byte) (*MultisigTx, error) {
+	var mtx MultisigTx
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&mtx); err != nil {
+		return nil, err
+	}
+	if _, _, ok := ExtractMultisig(mtx.Script); !ok || len(mtx.Signatures) != len(mtx.Tx.Inputs) {
+		return nil, errors.New("invalid multisig transaction")
+	}
+	return &mtx, nil
+}
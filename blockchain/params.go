@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// hard-coded checkpoints (height -> block hash) of the known networks, every
+// chain created with createblockchain has its own genesis so there is none yet
+var defaultCheckpoints = map[int]string{}
+
+type ChainParams struct {
+	Checkpoints map[int][]byte
+}
+
+var Params = ChainParams{Checkpoints: decodeCheckpoints(defaultCheckpoints)}
+
+func decodeCheckpoints(checkpoints map[int]string) map[int][]byte {
+	decoded := make(map[int][]byte)
+
+	for height, hash := range checkpoints {
+		h, err := hex.DecodeString(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		decoded[height] = h
+	}
+
+	return decoded
+}
+
+// AddCheckpoint adds a configured checkpoint to the hard-coded ones
+func (p *ChainParams) AddCheckpoint(height int, hash []byte) {
+	p.Checkpoints[height] = hash
+}
+
+// LastCheckpoint returns the height of the highest checkpoint, -1 when there is none
+func (p *ChainParams) LastCheckpoint() int {
+	last := -1
+
+	for height := range p.Checkpoints {
+		if height > last {
+			last = height
+		}
+	}
+
+	return last
+}
+
+// isCheckpointed tells whether block is the last checkpoint or one of its
+// stored ancestors, the checkpoint hash then commits to its transactions
+func (chain *BlockChain) isCheckpointed(block *Block) bool {
+	last := Params.LastCheckpoint()
+	if last < 0 || block.Height > last {
+		return false
+	}
+
+	hash := Params.Checkpoints[last]
+	for {
+		if bytes.Equal(hash, block.Hash) {
+			return true
+		}
+
+		ancestor, err := chain.getBlock(hash)
+		if err != nil || ancestor.Height <= block.Height {
+			return false
+		}
+		hash = ancestor.PrevHash
+	}
+}
+
+// CheckCheckpoint rejects a block conflicting with a checkpoint or forking the
+// main chain below the last checkpoint
+func (chain *BlockChain) CheckCheckpoint(block *Block) error {
+	if hash, ok := Params.Checkpoints[block.Height]; ok && !bytes.Equal(hash, block.Hash) {
+		return fmt.Errorf("block %d does not match the checkpoint %x", block.Height, hash)
+	}
+
+	if block.Height > Params.LastCheckpoint() || block.Height > chain.GetBestHeight() {
+		return nil
+	}
+
+	iter := chain.Iterator()
+	for {
+		mainBlock := iter.Next()
+
+		if mainBlock.Height == block.Height {
+			if !bytes.Equal(mainBlock.Hash, block.Hash) {
+				return fmt.Errorf("block %d forks the chain below the last checkpoint", block.Height)
+			}
+			return nil
+		}
+
+		if !iter.HasNext() {
+			return nil
+		}
+	}
+}
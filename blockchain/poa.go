@@ -0,0 +1,108 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/nclv/golang-blockchain/wallet"
+)
+
+// PoAEngine is a proof of authority engine, the configured signers seal the
+// blocks in rotation: the block at height h is signed by Signers[h % len(Signers)]
+type PoAEngine struct {
+	Signers [][]byte          // public keys, X and Y concatenated like wallet.Wallet.PublicKey
+	Key     *ecdsa.PrivateKey // nil when the node does not sign blocks
+}
+
+func NewPoAEngine(signers [][]byte, key *ecdsa.PrivateKey) *PoAEngine {
+	return &PoAEngine{signers, key}
+}
+
+func (e *PoAEngine) signer(height int) []byte {
+	return e.Signers[height%len(e.Signers)]
+}
+
+// InTurn tells whether the local key is the signer of the block at height
+func (e *PoAEngine) InTurn(height int) bool {
+	if e.Key == nil || len(e.Signers) == 0 {
+		return false
+	}
+	pubKey := wallet.PublicKeyBytes(e.Key.PublicKey)
+
+	return bytes.Equal(pubKey, e.signer(height))
+}
+
+func (e *PoAEngine) headerHash(block *Block) []byte {
+	data := bytes.Join(
+		[][]byte{
+			block.PrevHash,
+			block.HashTransactions(),
+			ToBytes(int64(block.Height)),
+			ToBytes(block.Timestamp),
+		},
+		[]byte{},
+	)
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
+func (e *PoAEngine) Seal(block *Block) error {
+	if !e.InTurn(block.Height) {
+		return fmt.Errorf("not in turn to sign block %d", block.Height)
+	}
+
+	hash := e.headerHash(block)
+	r, s, err := ecdsa.Sign(rand.Reader, e.Key, hash)
+	if err != nil {
+		return err
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	block.Hash = hash
+	block.Signature = signature
+
+	return nil
+}
+
+func (e *PoAEngine) VerifyHeader(block *Block) error {
+	if len(e.Signers) == 0 {
+		return errors.New("no proof of authority signers configured")
+	}
+
+	hash := e.headerHash(block)
+	if !bytes.Equal(hash, block.Hash) {
+		return errors.New("block hash does not match its header")
+	}
+	if len(block.Signature) != 64 {
+		return errors.New("invalid block signature length")
+	}
+
+	signer := e.signer(block.Height)
+	keyLen := len(signer)
+	x := new(big.Int).SetBytes(signer[:keyLen/2])
+	y := new(big.Int).SetBytes(signer[keyLen/2:])
+	pubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	r := new(big.Int).SetBytes(block.Signature[:32])
+	s := new(big.Int).SetBytes(block.Signature[32:])
+	if !ecdsa.Verify(&pubKey, hash, r, s) {
+		return fmt.Errorf("block %d is not signed by the signer in turn", block.Height)
+	}
+
+	return nil
+}
+
+// CalcDifficulty is constant, every signer in turn has the same weight
+func (e *PoAEngine) CalcDifficulty(parent *Block) int {
+	return 1
+}
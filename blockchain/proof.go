@@ -8,6 +8,7 @@ import (
 	"log"
 	"math"
 	"math/big"
+	"time"
 )
 
 // Get block.Data
@@ -35,12 +36,21 @@ func NewProof(b *Block) *ProofOfWork {
 }
 
 func (pow *ProofOfWork) InitData(nonce int) []byte {
+	return PowData(pow.Block.PrevHash, pow.Block.HashTransactions(), pow.Block.Height, pow.Block.Timestamp, nonce, Difficulty)
+}
+
+// PowData is the header data hashed by the proof of work, external miners only
+// need the previous hash, the transactions merkle root, the height and the
+// timestamp to search a nonce
+func PowData(prevHash, txHash []byte, height int, timestamp int64, nonce, difficulty int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
+			prevHash,
+			txHash,
+			ToBytes(int64(height)),
+			ToBytes(timestamp),
 			ToBytes(int64(nonce)),
-			ToBytes(int64(Difficulty)),
+			ToBytes(int64(difficulty)),
 		},
 		[]byte{},
 	)
@@ -52,6 +62,7 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 	var hash [32]byte
 
 	nonce := 0
+	start := time.Now()
 
 	for nonce < math.MaxInt64 {
 		data := pow.InitData(nonce)
@@ -67,6 +78,7 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 		nonce++
 	}
 	fmt.Println()
+	recordHashrate(float64(nonce+1), time.Since(start))
 
 	return nonce, hash[:]
 }
@@ -82,6 +94,19 @@ func (pow *ProofOfWork) Validate() bool {
 	return intHash.Cmp(pow.Target) == -1
 }
 
+// Seal sets the block nonce and hash once an externally found nonce is validated
+func (pow *ProofOfWork) Seal(nonce int) bool {
+	pow.Block.Nonce = nonce
+	if !pow.Validate() {
+		return false
+	}
+
+	hash := sha256.Sum256(pow.InitData(nonce))
+	pow.Block.Hash = hash[:]
+
+	return true
+}
+
 func ToBytes(num int64) []byte {
 	buff := new(bytes.Buffer)
 	err := binary.Write(buff, binary.BigEndian, num)
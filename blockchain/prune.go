@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/dgraph-io/badger"
+)
+
+// MinPruneDepth keeps enough block bodies to reorganize the recent blocks
+const MinPruneDepth = 20
+
+var pruneKey = []byte("prunedepth")
+
+// Prune deletes the bodies of the blocks deeper than depth and keeps their
+// headers, the outputs they created are spent from the UTXO set
+func (chain *BlockChain) Prune(depth int) int {
+	if depth < MinPruneDepth {
+		log.Panicf("Prune depth must be at least %d blocks", MinPruneDepth)
+	}
+
+	// the stored UTXO tip must not stay below the blocks whose bodies and undo
+	// data are deleted, it could not be caught up after a crash
+	UTXOSet{chain}.Flush()
+
+	bestHeight := chain.GetBestHeight()
+	pruned := 0
+
+	// the history below a loaded snapshot is kept until it is validated
+	snapshotHeight := -1
+	if snapshot, ok := chain.Snapshot(); ok {
+		snapshotHeight = snapshot.Height
+	}
+
+	iter := chain.Iterator()
+	for {
+		block := iter.Next()
+
+		if block.Height < bestHeight-depth && block.Height > snapshotHeight && !block.IsPruned() {
+			header := *block
+			header.MerkleRoot = block.HashTransactions()
+			header.Transactions = nil
+
+			if err := chain.Database.Update(func(txn *badger.Txn) error {
+				if err := txn.Set(header.Hash, header.Serialize()); err != nil {
+					return err
+				}
+				// too deep to be disconnected, the undo data is not needed anymore
+				return txn.Delete(undoKey(header.Hash))
+			}); err != nil {
+				log.Panic(err)
+			}
+			pruned++
+		}
+
+		if !iter.HasNext() {
+			break
+		}
+	}
+
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(pruneKey, ToBytes(int64(depth)))
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	return pruned
+}
+
+// PruneDepth returns the depth used the last time the chain was pruned, 0 for
+// an archival node
+func (chain *BlockChain) PruneDepth() int {
+	depth := 0
+
+	if err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(pruneKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		depth = int(binary.BigEndian.Uint64(value))
+
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	return depth
+}
+
+func (chain *BlockChain) IsPruned() bool {
+	return chain.PruneDepth() > 0
+}
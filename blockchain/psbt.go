@@ -0,0 +1,250 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nclv/golang-blockchain/wallet"
+)
+
+// PSBT is a partially signed transaction: the unsigned transaction carries the
+// transactions whose outputs it spends so that it is signed by wallets without
+// the chain, the signatures are collected until the inputs can be unlocked.
+// The inputs spend pay to public key hash, multisig or pay to script hash
+// multisig outputs.
+type PSBT struct {
+	Tx Transaction
+	// for each input, the transaction of the spent output, checked against
+	// the input ID since the signatures do not commit to the spent values
+	PrevTxs []Transaction
+	// for each input, the redeem script of a pay to script hash output
+	RedeemScripts [][]byte
+	// for each input, the signatures by hex public key
+	Signatures []map[string][]byte
+}
+
+// NewPSBT prepares the unsigned tx for offline signing, redeemScript is the
+// redeem script of its pay to script hash inputs
+func NewPSBT(tx *Transaction, redeemScript []byte, UTXO *UTXOSet) (*PSBT, error) {
+	pending := make(map[string]*Transaction)
+	for _, pendingTx := range UTXO.BlockChain.PendingWalletTxs() {
+		pending[hex.EncodeToString(pendingTx.ID)] = pendingTx
+	}
+
+	p := &PSBT{
+		Tx:            *tx,
+		PrevTxs:       make([]Transaction, len(tx.Inputs)),
+		RedeemScripts: make([][]byte, len(tx.Inputs)),
+		Signatures:    make([]map[string][]byte, len(tx.Inputs)),
+	}
+	for inId, in := range tx.Inputs {
+		if prevTx, ok := pending[hex.EncodeToString(in.ID)]; ok {
+			p.PrevTxs[inId] = *prevTx
+		} else {
+			prevTx, err := UTXO.BlockChain.FindTransaction(in.ID)
+			if err != nil {
+				return nil, fmt.Errorf("transaction %x spent by input %d: %s", in.ID, inId, err)
+			}
+			p.PrevTxs[inId] = prevTx
+		}
+		if err := p.checkPrevTx(inId); err != nil {
+			return nil, err
+		}
+		prevOut := p.prevOut(inId)
+
+		if scriptHash, ok := ExtractScriptHash(prevOut.ScriptPubKey); ok {
+			if !bytes.Equal(wallet.PublicKeyHash(redeemScript), scriptHash) {
+				return nil, fmt.Errorf("the redeem script does not match the output spent by input %d", inId)
+			}
+			p.RedeemScripts[inId] = redeemScript
+		}
+	}
+
+	return p, nil
+}
+
+// checkPrevTx rejects a previous transaction that is not the one spent by the
+// input inId, its outputs could carry other values
+func (p *PSBT) checkPrevTx(inId int) error {
+	in := p.Tx.Inputs[inId]
+	prevTx := &p.PrevTxs[inId]
+
+	if !bytes.Equal(prevTx.ID, in.ID) || !bytes.Equal(transactionID(prevTx), in.ID) {
+		return fmt.Errorf("the previous transaction of input %d is not %x", inId, in.ID)
+	}
+	if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+		return fmt.Errorf("output %d of transaction %x does not exist", in.Out, in.ID)
+	}
+
+	return nil
+}
+
+// prevOut returns the output spent by the input inId
+func (p *PSBT) prevOut(inId int) TxOutput {
+	return p.PrevTxs[inId].Outputs[p.Tx.Inputs[inId].Out]
+}
+
+// prevOuts returns the outputs spent by the inputs
+func (p *PSBT) prevOuts() map[Outpoint]TxOutput {
+	prevOuts := make(map[Outpoint]TxOutput)
+	for inId, in := range p.Tx.Inputs {
+		prevOuts[in.Outpoint()] = p.prevOut(inId)
+	}
+
+	return prevOuts
+}
+
+// script returns the script signed by the input: the redeem script of a pay to
+// script hash output or the locking script
+func (p *PSBT) script(inId int) []byte {
+	if _, ok := ExtractScriptHash(p.prevOut(inId).ScriptPubKey); ok {
+		return p.RedeemScripts[inId]
+	}
+	return p.prevOut(inId).ScriptPubKey
+}
+
+// Sign adds the signatures of w to the inputs it unlocks and returns their
+// number
+func (p *PSBT) Sign(w *wallet.Wallet, hashType byte) (int, error) {
+	pubKey := w.PublicKey
+
+	signed := 0
+	for inId := range p.Tx.Inputs {
+		script := p.script(inId)
+
+		member := false
+		if pubKeyHash, ok := ExtractPubKeyHash(script); ok {
+			member = bytes.Equal(wallet.PublicKeyHash(pubKey), pubKeyHash)
+		} else if _, pubKeys, ok := ExtractMultisig(script); ok {
+			for _, key := range pubKeys {
+				member = member || bytes.Equal(key, pubKey)
+			}
+		}
+		if !member {
+			continue
+		}
+
+		signature, err := p.Tx.InputSignature(inId, script, w.PrivateKey, hashType)
+		if err != nil {
+			return signed, err
+		}
+		if p.Signatures[inId] == nil {
+			p.Signatures[inId] = make(map[string][]byte)
+		}
+		p.Signatures[inId][hex.EncodeToString(pubKey)] = signature
+		signed++
+	}
+
+	return signed, nil
+}
+
+// scriptSig builds the unlocking script of an input from its signatures
+func (p *PSBT) scriptSig(inId int) ([]byte, error) {
+	script := p.script(inId)
+	signatures := p.Signatures[inId]
+
+	var scriptSig []byte
+	if pubKeyHash, ok := ExtractPubKeyHash(script); ok {
+		for key, signature := range signatures {
+			pubKey, err := hex.DecodeString(key)
+			if err == nil && bytes.Equal(wallet.PublicKeyHash(pubKey), pubKeyHash) {
+				scriptSig = P2PKHScriptSig(signature, pubKey)
+			}
+		}
+		if scriptSig == nil {
+			return nil, fmt.Errorf("input %d is not signed", inId)
+		}
+	} else if m, pubKeys, ok := ExtractMultisig(script); ok {
+		// in the order of the public keys
+		var collected [][]byte
+		for _, pubKey := range pubKeys {
+			if signature, ok := signatures[hex.EncodeToString(pubKey)]; ok && len(collected) < m {
+				collected = append(collected, signature)
+			}
+		}
+		if len(collected) < m {
+			return nil, fmt.Errorf("input %d misses %d signatures", inId, m-len(collected))
+		}
+		scriptSig = MultisigScriptSig(collected)
+	} else {
+		return nil, fmt.Errorf("the output spent by input %d cannot be signed", inId)
+	}
+
+	if !bytes.Equal(script, p.prevOut(inId).ScriptPubKey) {
+		scriptSig = pushData(scriptSig, script)
+	}
+
+	return scriptSig, nil
+}
+
+// Missing returns the number of inputs that cannot be unlocked yet
+func (p *PSBT) Missing() int {
+	missing := 0
+	for inId := range p.Tx.Inputs {
+		if _, err := p.scriptSig(inId); err != nil {
+			missing++
+		}
+	}
+
+	return missing
+}
+
+// Fee returns the value of the spent outputs that is not sent to the outputs
+func (p *PSBT) Fee() (int, error) {
+	return p.Tx.Fee(p.prevOuts())
+}
+
+// Finalize builds the unlocking scripts once every input is signed
+func (p *PSBT) Finalize() (*Transaction, error) {
+	tx := p.Tx
+	tx.Inputs = append([]TxInput{}, p.Tx.Inputs...)
+
+	for inId := range tx.Inputs {
+		scriptSig, err := p.scriptSig(inId)
+		if err != nil {
+			return nil, err
+		}
+		tx.Inputs[inId].ScriptSig = scriptSig
+	}
+	// the ID of the partially signed transaction is not trusted
+	tx.ID = transactionID(&tx)
+
+	if !tx.Verify(p.prevOuts()) {
+		return nil, errors.New("the collected signatures do not unlock the outputs")
+	}
+
+	return &tx, nil
+}
+
+func (p *PSBT) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(p); err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializePSBT(data []byte) (*PSBT, error) {
+	var p PSBT
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&p); err != nil {
+		return nil, err
+	}
+
+	inputs := len(p.Tx.Inputs)
+	if inputs == 0 || len(p.PrevTxs) != inputs || len(p.RedeemScripts) != inputs || len(p.Signatures) != inputs {
+		return nil, errors.New("invalid partially signed transaction")
+	}
+	for inId := range p.Tx.Inputs {
+		if err := p.checkPrevTx(inId); err != nil {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
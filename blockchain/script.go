@@ -0,0 +1,730 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/nclv/golang-blockchain/wallet"
+)
+
+// An output is locked by a script, ScriptPubKey, and an input unlocks it with
+// its ScriptSig. The unlocking script can only push data, it is run first and
+// the locking script then runs on the resulting stack. The output is spent if
+// no opcode fails and the top of the stack is true. For a pay to script hash
+// output, the redeem script pushed last by the unlocking script must then
+// succeed too.
+
+const (
+	OP_0              byte = 0x00
+	OP_PUSHDATA1      byte = 0x4c
+	OP_PUSHDATA2      byte = 0x4d
+	OP_1              byte = 0x51
+	OP_16             byte = 0x60
+	OP_NOP            byte = 0x61
+	OP_IF             byte = 0x63
+	OP_NOTIF          byte = 0x64
+	OP_ELSE           byte = 0x67
+	OP_ENDIF          byte = 0x68
+	OP_VERIFY         byte = 0x69
+	OP_RETURN         byte = 0x6a
+	OP_DROP           byte = 0x75
+	OP_DUP            byte = 0x76
+	OP_EQUAL          byte = 0x87
+	OP_EQUALVERIFY    byte = 0x88
+	OP_SHA256         byte = 0xa8
+	OP_HASH160        byte = 0xa9
+	OP_CHECKSIG       byte = 0xac
+	OP_CHECKSIGVERIFY byte = 0xad
+
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKMULTISIGVERIFY byte = 0xaf
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+)
+
+const (
+	MaxScriptSize        = 10000
+	MaxScriptElementSize = 520
+	MaxStackSize         = 1000
+	// pushes are not counted, a multisig check counts one per public key
+	MaxOpsPerScript = 201
+	MaxMultisigKeys = 16
+	// data of an OP_RETURN output
+	MaxDataCarrierSize = 80
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:              "OP_0",
+	OP_PUSHDATA1:      "OP_PUSHDATA1",
+	OP_PUSHDATA2:      "OP_PUSHDATA2",
+	OP_NOP:            "OP_NOP",
+	OP_IF:             "OP_IF",
+	OP_NOTIF:          "OP_NOTIF",
+	OP_ELSE:           "OP_ELSE",
+	OP_ENDIF:          "OP_ENDIF",
+	OP_VERIFY:         "OP_VERIFY",
+	OP_RETURN:         "OP_RETURN",
+	OP_DROP:           "OP_DROP",
+	OP_DUP:            "OP_DUP",
+	OP_EQUAL:          "OP_EQUAL",
+	OP_EQUALVERIFY:    "OP_EQUALVERIFY",
+	OP_SHA256:         "OP_SHA256",
+	OP_HASH160:        "OP_HASH160",
+	OP_CHECKSIG:       "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+// ScriptOp is a parsed opcode with the data it pushes
+type ScriptOp struct {
+	Opcode byte
+	Data   []byte
+}
+
+func (op ScriptOp) IsPush() bool {
+	return op.Opcode <= OP_PUSHDATA2 || (op.Opcode >= OP_1 && op.Opcode <= OP_16)
+}
+
+func (op ScriptOp) String() string {
+	switch {
+	case op.Opcode == OP_0:
+		return "OP_0"
+	case op.Opcode <= OP_PUSHDATA2:
+		return hex.EncodeToString(op.Data)
+	case op.Opcode >= OP_1 && op.Opcode <= OP_16:
+		return fmt.Sprintf("OP_%d", op.Opcode-OP_1+1)
+	}
+	if name, ok := opcodeNames[op.Opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_UNKNOWN%d", op.Opcode)
+}
+
+// ParseScript splits a script into its opcodes
+func ParseScript(script []byte) ([]ScriptOp, error) {
+	var ops []ScriptOp
+
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		size := 0
+		switch {
+		case opcode < OP_PUSHDATA1:
+			size = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errors.New("truncated OP_PUSHDATA1")
+			}
+			size = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errors.New("truncated OP_PUSHDATA2")
+			}
+			size = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+
+		if i+size > len(script) {
+			return nil, fmt.Errorf("push of %d bytes past the end of the script", size)
+		}
+		var data []byte
+		if opcode <= OP_PUSHDATA2 {
+			data = script[i : i+size]
+		}
+		i += size
+
+		ops = append(ops, ScriptOp{opcode, data})
+	}
+
+	return ops, nil
+}
+
+// DisassembleScript returns the opcodes of a script in a readable form
+func DisassembleScript(script []byte) string {
+	ops, err := ParseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid script %x]", script)
+	}
+
+	var words []string
+	for _, op := range ops {
+		words = append(words, op.String())
+	}
+
+	return strings.Join(words, " ")
+}
+
+// pushData appends the shortest push of data to script
+func pushData(script, data []byte) []byte {
+	switch {
+	case len(data) < int(OP_PUSHDATA1):
+		script = append(script, byte(len(data)))
+	case len(data) <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		size := make([]byte, 2)
+		binary.LittleEndian.PutUint16(size, uint16(len(data)))
+		script = append(append(script, OP_PUSHDATA2), size...)
+	}
+
+	return append(script, data...)
+}
+
+// P2PKHScript locks an output to the owner of the public key hashed to pubKeyHash
+func P2PKHScript(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = pushData(script, pubKeyHash)
+
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+func P2PKHScriptSig(signature, pubKey []byte) []byte {
+	return pushData(pushData(nil, signature), pubKey)
+}
+
+// ExtractPubKeyHash returns the public key hash of a pay to public key hash script
+func ExtractPubKeyHash(script []byte) ([]byte, bool) {
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) != 5 {
+		return nil, false
+	}
+	if ops[0].Opcode != OP_DUP || ops[1].Opcode != OP_HASH160 || !ops[2].IsPush() ||
+		ops[3].Opcode != OP_EQUALVERIFY || ops[4].Opcode != OP_CHECKSIG {
+		return nil, false
+	}
+
+	return ops[2].Data, true
+}
+
+// P2SHScript locks an output to the redeem script hashed to scriptHash, the
+// spender pushes the redeem script after the data unlocking it
+func P2SHScript(scriptHash []byte) []byte {
+	script := []byte{OP_HASH160}
+	script = pushData(script, scriptHash)
+
+	return append(script, OP_EQUAL)
+}
+
+// ExtractScriptHash returns the redeem script hash of a pay to script hash script
+func ExtractScriptHash(script []byte) ([]byte, bool) {
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) != 3 {
+		return nil, false
+	}
+	if ops[0].Opcode != OP_HASH160 || !ops[1].IsPush() || len(ops[1].Data) != 20 || ops[2].Opcode != OP_EQUAL {
+		return nil, false
+	}
+
+	return ops[1].Data, true
+}
+
+// DataScript carries data in a provably unspendable output: OP_RETURN <data>
+func DataScript(data []byte) ([]byte, error) {
+	if len(data) > MaxDataCarrierSize {
+		return nil, fmt.Errorf("data of %d bytes exceeds %d bytes", len(data), MaxDataCarrierSize)
+	}
+
+	return pushData([]byte{OP_RETURN}, data), nil
+}
+
+// ExtractData returns the data carried by an OP_RETURN script
+func ExtractData(script []byte) ([]byte, bool) {
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) != 2 || ops[0].Opcode != OP_RETURN || !ops[1].IsPush() {
+		return nil, false
+	}
+
+	return ops[1].Data, true
+}
+
+// IsUnspendable tells whether script fails whatever unlocks it, such outputs
+// are not added to the UTXO set
+func IsUnspendable(script []byte) bool {
+	return len(script) > 0 && script[0] == OP_RETURN
+}
+
+// ScriptHashAddress returns the pay to script hash address of a redeem script,
+// the redeem script is pushed to spend the outputs so it cannot exceed
+// MaxScriptElementSize bytes
+func ScriptHashAddress(redeemScript []byte) (string, error) {
+	if len(redeemScript) > MaxScriptElementSize {
+		return "", fmt.Errorf("the redeem script of %d bytes exceeds %d bytes", len(redeemScript), MaxScriptElementSize)
+	}
+
+	return string(wallet.EncodeAddress(wallet.ScriptHashVersion, wallet.PublicKeyHash(redeemScript))), nil
+}
+
+func verifySignature(pubKey, signature, hash []byte) bool {
+	if len(pubKey) == 0 || len(pubKey)%2 != 0 {
+		return false
+	}
+	r, s, err := ParseSignature(signature)
+	if err != nil {
+		return false
+	}
+
+	x := new(big.Int).SetBytes(pubKey[:len(pubKey)/2])
+	y := new(big.Int).SetBytes(pubKey[len(pubKey)/2:])
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	return ecdsa.Verify(&rawPubKey, hash, r, s)
+}
+
+// scriptNumber decodes a little endian sign and magnitude number of at most
+// maxLen bytes, OP_1 to OP_16 push one byte numbers
+func scriptNumber(value []byte, maxLen int) (int64, error) {
+	if len(value) > maxLen {
+		return 0, fmt.Errorf("number of %d bytes exceeds %d bytes", len(value), maxLen)
+	}
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	var n int64
+	for i, b := range value {
+		n |= int64(b) << uint(8*i)
+	}
+
+	// the sign bit is the high bit of the last byte
+	last := value[len(value)-1]
+	if last&0x80 != 0 {
+		n &= ^(int64(0x80) << uint(8*(len(value)-1)))
+		return -n, nil
+	}
+
+	return n, nil
+}
+
+// numberBytes encodes n as a script number
+func numberBytes(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+
+	var value []byte
+	for ; n > 0; n >>= 8 {
+		value = append(value, byte(n))
+	}
+
+	// an extra byte holds the sign if the high bit is taken
+	last := len(value) - 1
+	switch {
+	case value[last]&0x80 != 0 && negative:
+		value = append(value, 0x80)
+	case value[last]&0x80 != 0:
+		value = append(value, 0)
+	case negative:
+		value[last] |= 0x80
+	}
+
+	return value
+}
+
+// pushNumber appends the shortest push of n to script
+func pushNumber(script []byte, n int64) []byte {
+	if n >= 0 && n <= 16 {
+		return append(script, smallInt(int(n)))
+	}
+
+	return pushData(script, numberBytes(n))
+}
+
+// smallInt returns the opcode pushing n, for 0 <= n <= 16
+func smallInt(n int) byte {
+	if n == 0 {
+		return OP_0
+	}
+	return OP_1 + byte(n-1)
+}
+
+func castToBool(value []byte) bool {
+	for i, b := range value {
+		if b != 0 {
+			// negative zero
+			return !(i == len(value)-1 && b == 0x80)
+		}
+	}
+
+	return false
+}
+
+// scriptVM runs the scripts spending the input index of tx
+type scriptVM struct {
+	tx     *Transaction
+	index  int
+	stack  [][]byte
+	script []byte
+	ops    int
+}
+
+func (vm *scriptVM) push(data []byte) error {
+	if len(data) > MaxScriptElementSize {
+		return fmt.Errorf("push of %d bytes exceeds %d bytes", len(data), MaxScriptElementSize)
+	}
+	if len(vm.stack) >= MaxStackSize {
+		return errors.New("stack size limit exceeded")
+	}
+	vm.stack = append(vm.stack, data)
+
+	return nil
+}
+
+func (vm *scriptVM) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("pop from an empty stack")
+	}
+	top := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+
+	return top, nil
+}
+
+func (vm *scriptVM) peek() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("peek into an empty stack")
+	}
+
+	return vm.stack[len(vm.stack)-1], nil
+}
+
+func (vm *scriptVM) verify() error {
+	top, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	if !castToBool(top) {
+		return errors.New("verify failed")
+	}
+
+	return nil
+}
+
+func (vm *scriptVM) run(script []byte) error {
+	if len(script) > MaxScriptSize {
+		return fmt.Errorf("script of %d bytes exceeds %d bytes", len(script), MaxScriptSize)
+	}
+
+	ops, err := ParseScript(script)
+	if err != nil {
+		return err
+	}
+
+	vm.script = script
+	vm.ops = 0
+
+	// one condition per open OP_IF, the opcodes of a branch are skipped unless
+	// all the conditions are true
+	var conditions []bool
+	executing := func() bool {
+		for _, condition := range conditions {
+			if !condition {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range ops {
+		if !op.IsPush() {
+			vm.ops++
+			if vm.ops > MaxOpsPerScript {
+				return errors.New("opcode limit exceeded")
+			}
+		}
+
+		switch op.Opcode {
+		case OP_IF, OP_NOTIF:
+			condition := false
+			if executing() {
+				top, err := vm.pop()
+				if err != nil {
+					return fmt.Errorf("%s: %w", op, err)
+				}
+				condition = castToBool(top) == (op.Opcode == OP_IF)
+			}
+			conditions = append(conditions, condition)
+			continue
+		case OP_ELSE, OP_ENDIF:
+			if len(conditions) == 0 {
+				return fmt.Errorf("%s without OP_IF", op)
+			}
+			if op.Opcode == OP_ELSE {
+				conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			} else {
+				conditions = conditions[:len(conditions)-1]
+			}
+			continue
+		}
+
+		if !executing() {
+			continue
+		}
+
+		if op.IsPush() {
+			data := op.Data
+			if op.Opcode >= OP_1 {
+				data = []byte{op.Opcode - OP_1 + 1}
+			}
+			if err := vm.push(data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := vm.execute(op); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if len(conditions) > 0 {
+		return errors.New("OP_IF without OP_ENDIF")
+	}
+
+	return nil
+}
+
+func (vm *scriptVM) execute(op ScriptOp) error {
+	switch op.Opcode {
+	case OP_NOP:
+		return nil
+	case OP_VERIFY:
+		return vm.verify()
+	case OP_RETURN:
+		return errors.New("unspendable output")
+	case OP_DROP:
+		_, err := vm.pop()
+		return err
+	case OP_DUP:
+		top, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		return vm.push(top)
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if err := vm.push(boolBytes(bytes.Equal(a, b))); err != nil {
+			return err
+		}
+		if op.Opcode == OP_EQUALVERIFY {
+			return vm.verify()
+		}
+		return nil
+	case OP_SHA256:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(top)
+		return vm.push(hash[:])
+	case OP_HASH160:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		return vm.push(wallet.PublicKeyHash(top))
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if err := vm.push(boolBytes(vm.tx.checkSignature(vm.index, vm.script, pubKey, signature))); err != nil {
+			return err
+		}
+		if op.Opcode == OP_CHECKSIGVERIFY {
+			return vm.verify()
+		}
+		return nil
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := vm.checkMultisig()
+		if err != nil {
+			return err
+		}
+		if err := vm.push(boolBytes(ok)); err != nil {
+			return err
+		}
+		if op.Opcode == OP_CHECKMULTISIGVERIFY {
+			return vm.verify()
+		}
+		return nil
+	case OP_CHECKLOCKTIMEVERIFY:
+		top, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		lockTime, err := scriptNumber(top, 5)
+		if err != nil {
+			return err
+		}
+		return vm.checkLockTime(lockTime)
+	default:
+		return errors.New("unknown opcode")
+	}
+}
+
+// checkLockTime checks that the transaction cannot be mined before lockTime,
+// a height or a unix time like the lock time of the transaction
+func (vm *scriptVM) checkLockTime(lockTime int64) error {
+	if lockTime < 0 {
+		return errors.New("negative lock time")
+	}
+	if (lockTime < LockTimeThreshold) != (vm.tx.LockTime < LockTimeThreshold) {
+		return errors.New("the lock time and the transaction lock time are not of the same kind")
+	}
+	if lockTime > vm.tx.LockTime {
+		return fmt.Errorf("the transaction lock time is before %d", lockTime)
+	}
+	// the lock time of the transaction is not enforced for a final input
+	if vm.tx.Inputs[vm.index].Sequence == SequenceFinal {
+		return errors.New("the input is final")
+	}
+
+	return nil
+}
+
+// checkMultisig pops N, the N public keys, M and the M signatures, which must
+// be in the order of their public keys
+func (vm *scriptVM) checkMultisig() (bool, error) {
+	popNumber := func(max int) (int, error) {
+		value, err := vm.pop()
+		if err != nil {
+			return 0, err
+		}
+		n, err := scriptNumber(value, 4)
+		if err != nil {
+			return 0, err
+		}
+		if n < 0 || n > int64(max) {
+			return 0, fmt.Errorf("count %d out of range", n)
+		}
+		return int(n), nil
+	}
+
+	n, err := popNumber(MaxMultisigKeys)
+	if err != nil {
+		return false, err
+	}
+	vm.ops += n
+	if vm.ops > MaxOpsPerScript {
+		return false, errors.New("opcode limit exceeded")
+	}
+
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = vm.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := popNumber(n)
+	if err != nil {
+		return false, err
+	}
+
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if signatures[i], err = vm.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	key := 0
+	for _, signature := range signatures {
+		for key < len(pubKeys) && !vm.tx.checkSignature(vm.index, vm.script, pubKeys[key], signature) {
+			key++
+		}
+		if key == len(pubKeys) {
+			return false, nil
+		}
+		key++
+	}
+
+	return true, nil
+}
+
+func boolBytes(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+	return nil
+}
+
+// ExecuteScript checks that scriptSig unlocks scriptPubKey for the input
+// index of tx
+func ExecuteScript(scriptSig, scriptPubKey []byte, tx *Transaction, index int) error {
+	ops, err := ParseScript(scriptSig)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if !op.IsPush() {
+			return errors.New("the unlocking script is not push only")
+		}
+	}
+
+	vm := scriptVM{tx: tx, index: index}
+	if err := vm.run(scriptSig); err != nil {
+		return err
+	}
+	unlockingStack := append([][]byte{}, vm.stack...)
+
+	if err := vm.run(scriptPubKey); err != nil {
+		return err
+	}
+	if err := vm.checkTrue(); err != nil {
+		return err
+	}
+
+	if _, ok := ExtractScriptHash(scriptPubKey); !ok {
+		return nil
+	}
+
+	// the hash matched the redeem script, the last push, which is then run on
+	// the data pushed before it
+	redeemScript := unlockingStack[len(unlockingStack)-1]
+	vm.stack = unlockingStack[:len(unlockingStack)-1]
+	if err := vm.run(redeemScript); err != nil {
+		return fmt.Errorf("redeem script: %w", err)
+	}
+
+	return vm.checkTrue()
+}
+
+func (vm *scriptVM) checkTrue() error {
+	top, err := vm.peek()
+	if err != nil {
+		return err
+	}
+	if !castToBool(top) {
+		return errors.New("the script evaluated to false")
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Signature hash types, appended to the signatures, select the parts of the
+// transaction a signature commits to
+const (
+	// SigHashAll signs every input and output
+	SigHashAll byte = 0x01
+	// SigHashNone signs the inputs only, the outputs can be changed
+	SigHashNone byte = 0x02
+	// SigHashSingle signs the inputs and the output of the same index
+	SigHashSingle byte = 0x03
+	// SigHashAnyoneCanPay only signs the input itself, other inputs can be
+	// added
+	SigHashAnyoneCanPay byte = 0x80
+)
+
+// SigHashTypes are the hash types by name
+var SigHashTypes = map[string]byte{
+	"ALL":                 SigHashAll,
+	"NONE":                SigHashNone,
+	"SINGLE":              SigHashSingle,
+	"ALL|ANYONECANPAY":    SigHashAll | SigHashAnyoneCanPay,
+	"NONE|ANYONECANPAY":   SigHashNone | SigHashAnyoneCanPay,
+	"SINGLE|ANYONECANPAY": SigHashSingle | SigHashAnyoneCanPay,
+}
+
+func validSigHashType(hashType byte) bool {
+	base := hashType &^ SigHashAnyoneCanPay
+	return base >= SigHashAll && base <= SigHashSingle
+}
+
+// SignatureHash is the hash signed to spend the input index, the unlocking
+// scripts are cleared and the one of the input is replaced by scriptPubKey.
+// The ID is not signed since it changes when inputs or outputs are added.
+func (tx *Transaction) SignatureHash(index int, scriptPubKey []byte, hashType byte) ([]byte, error) {
+	if !validSigHashType(hashType) {
+		return nil, fmt.Errorf("unknown signature hash type %#x", hashType)
+	}
+	if index < 0 || index >= len(tx.Inputs) {
+		return nil, fmt.Errorf("input %d does not exist", index)
+	}
+
+	txCopy := tx.TrimmedCopy()
+	txCopy.ID = nil
+	txCopy.Inputs[index].ScriptSig = scriptPubKey
+
+	switch hashType &^ SigHashAnyoneCanPay {
+	case SigHashNone:
+		txCopy.Outputs = nil
+	case SigHashSingle:
+		if index >= len(txCopy.Outputs) {
+			return nil, errors.New("no output matches the input signed with SIGHASH_SINGLE")
+		}
+		// the previous outputs can be changed but not removed
+		txCopy.Outputs = txCopy.Outputs[:index+1]
+		for outIdx := 0; outIdx < index; outIdx++ {
+			txCopy.Outputs[outIdx] = TxOutput{-1, nil}
+		}
+	}
+
+	if hashType&^SigHashAnyoneCanPay != SigHashAll {
+		// the other signers can update their sequence
+		for inId := range txCopy.Inputs {
+			if inId != index {
+				txCopy.Inputs[inId].Sequence = 0
+			}
+		}
+	}
+
+	if hashType&SigHashAnyoneCanPay != 0 {
+		txCopy.Inputs = txCopy.Inputs[index : index+1]
+	}
+
+	hash := sha256.Sum256(append(txCopy.Serialize(), hashType))
+
+	return hash[:], nil
+}
+
+// InputSignature signs the input index spending an output locked by
+// scriptPubKey, the hash type is appended to the signature
+func (tx *Transaction) InputSignature(index int, scriptPubKey []byte, privKey ecdsa.PrivateKey, hashType byte) ([]byte, error) {
+	hash, err := tx.SignatureHash(index, scriptPubKey, hashType)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := SignHash(&privKey, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(signature, hashType), nil
+}
+
+// checkSignature verifies a signature of the input index followed by its hash
+// type
+func (tx *Transaction) checkSignature(index int, scriptPubKey, pubKey, signature []byte) bool {
+	if len(signature) == 0 {
+		return false
+	}
+
+	hashType := signature[len(signature)-1]
+	hash, err := tx.SignatureHash(index, scriptPubKey, hashType)
+	if err != nil {
+		return false
+	}
+
+	return verifySignature(pubKey, signature[:len(signature)-1], hash)
+}
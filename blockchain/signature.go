@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// curveHalfOrder is the highest S of a signature: (R, S) and (R, N - S) are
+// both valid, only the low S is accepted so that a signature cannot be changed
+// by a third party
+var curveHalfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+// ecdsaSignature is the DER sequence of a signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// SignHash returns the DER encoded signature of hash with a low S
+func SignHash(privKey *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, hash)
+	if err != nil {
+		return nil, err
+	}
+	if s.Cmp(curveHalfOrder) > 0 {
+		s.Sub(privKey.Curve.Params().N, s)
+	}
+
+	return asn1.Marshal(ecdsaSignature{r, s})
+}
+
+// ParseSignature decodes a DER signature, the encodings other than the
+// minimal one and the high S are rejected
+func ParseSignature(signature []byte) (*big.Int, *big.Int, error) {
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(signature, &sig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) > 0 {
+		return nil, nil, errors.New("trailing bytes after the signature")
+	}
+
+	if der, err := asn1.Marshal(sig); err != nil || !bytes.Equal(der, signature) {
+		return nil, nil, errors.New("the signature is not strictly DER encoded")
+	}
+
+	n := elliptic.P256().Params().N
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.Cmp(n) >= 0 || sig.S.Cmp(n) >= 0 {
+		return nil, nil, errors.New("the signature values are out of range")
+	}
+	if sig.S.Cmp(curveHalfOrder) > 0 {
+		return nil, nil, errors.New("the signature has a high S")
+	}
+
+	return sig.R, sig.S, nil
+}
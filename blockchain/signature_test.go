@@ -0,0 +1,122 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/nclv/golang-blockchain/wallet"
+)
+
+// a fresh key for each signature also covers the public keys with leading
+// zeros, about 1 in 128 keys
+const signatureRuns = 5000
+
+func TestSignaturesVerify(t *testing.T) {
+	for i := 0; i < signatureRuns; i++ {
+		privKey, pubKey := wallet.NewKeyPair()
+		hash := sha256.Sum256([]byte(fmt.Sprintf("message %d", i)))
+
+		signature, err := SignHash(&privKey, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pubKey) != 64 {
+			t.Fatalf("run %d: public key of %d bytes", i, len(pubKey))
+		}
+		if !verifySignature(pubKey, signature, hash[:]) {
+			t.Fatalf("run %d: signature %x by %x does not verify", i, signature, pubKey)
+		}
+
+		_, s, err := ParseSignature(signature)
+		if err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		if s.Cmp(curveHalfOrder) > 0 {
+			t.Fatalf("run %d: high S", i)
+		}
+	}
+}
+
+func TestTransactionSignaturesVerify(t *testing.T) {
+	for i := 0; i < signatureRuns/10; i++ {
+		w := wallet.MakeWallet()
+		prevOut := TxOutput{10, P2PKHScript(wallet.PublicKeyHash(w.PublicKey))}
+		in := TxInput{[]byte(fmt.Sprintf("previous %d", i)), 0, nil, SequenceFinal}
+
+		tx := Transaction{nil, []TxInput{in}, []TxOutput{prevOut}, 0}
+		tx.ID = tx.Hash()
+		prevOuts := map[Outpoint]TxOutput{in.Outpoint(): prevOut}
+		tx.Sign(w, prevOuts)
+
+		if !tx.Verify(prevOuts) {
+			t.Fatalf("run %d: transaction %x does not verify", i, tx.ID)
+		}
+	}
+}
+
+func TestHighSRejected(t *testing.T) {
+	privKey, pubKey := wallet.NewKeyPair()
+	hash := sha256.Sum256([]byte("message"))
+
+	signature, err := SignHash(&privKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ParseSignature(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same signature with N - S is valid for ECDSA
+	highS := new(big.Int).Sub(elliptic.P256().Params().N, s)
+	if !ecdsa.Verify(&privKey.PublicKey, hash[:], r, highS) {
+		t.Fatal("N - S does not verify")
+	}
+	malleated, err := asn1.Marshal(ecdsaSignature{r, highS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifySignature(pubKey, malleated, hash[:]) {
+		t.Fatal("a high S signature verifies")
+	}
+}
+
+func TestNonCanonicalSignaturesRejected(t *testing.T) {
+	privKey, pubKey := wallet.NewKeyPair()
+	hash := sha256.Sum256([]byte("message"))
+
+	signature, err := SignHash(&privKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ParseSignature(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the signatures before DER: R and S concatenated without padding
+	raw := append(r.Bytes(), s.Bytes()...)
+	// a longer length encoding of the same sequence
+	long := append([]byte{signature[0], 0x81}, signature[1:]...)
+	trailing := append(append([]byte{}, signature...), 0)
+
+	for name, invalid := range map[string][]byte{"raw": raw, "long length": long, "trailing": trailing, "empty": nil} {
+		if verifySignature(pubKey, invalid, hash[:]) {
+			t.Errorf("the %s signature verifies", name)
+		}
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	if verifySignature(pubKey, signature, random) {
+		t.Error("the signature verifies another hash")
+	}
+}
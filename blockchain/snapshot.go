@@ -0,0 +1,293 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+
+	"github.com/dgraph-io/badger"
+)
+
+// SnapshotVersion is the format version written in the UTXO snapshot files
+const SnapshotVersion = 2
+
+// present until the history below a loaded snapshot has been validated
+var snapshotKey = []byte("snapshot")
+
+// SnapshotHeader starts a UTXO snapshot file. It is followed by the base
+// block, the UTXO tip of the dumped set, and by Stats.Count entries.
+type SnapshotHeader struct {
+	Version   int
+	BlockHash []byte
+	Height    int
+	Stats     UTXOStats
+}
+
+type SnapshotEntry struct {
+	Outpoint Outpoint
+	Entry    UTXOEntry
+}
+
+func (h SnapshotHeader) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(h); err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeSnapshotHeader(data []byte) SnapshotHeader {
+	var header SnapshotHeader
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&header); err != nil {
+		log.Panic(err)
+	}
+	return header
+}
+
+// Dump writes the UTXO set at its tip block with its commitment hash
+func (u UTXOSet) Dump(w io.Writer) (SnapshotHeader, error) {
+	u.Flush()
+
+	base, err := u.BlockChain.getBlock(u.Tip())
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	if base.IsPruned() {
+		return SnapshotHeader{}, errors.New("the body of the UTXO tip is pruned")
+	}
+
+	header := SnapshotHeader{SnapshotVersion, base.Hash, base.Height, u.Stats()}
+
+	encoder := gob.NewEncoder(w)
+	if err := encoder.Encode(header); err != nil {
+		return header, err
+	}
+	if err := encoder.Encode(base); err != nil {
+		return header, err
+	}
+
+	u.ForEach(func(outpoint Outpoint, entry UTXOEntry) {
+		if err == nil {
+			err = encoder.Encode(SnapshotEntry{outpoint, entry})
+		}
+	})
+
+	return header, err
+}
+
+// LoadSnapshot creates the chain of nodeId from a UTXO snapshot. The blocks
+// are synced on top of its base block, the history below is downloaded and
+// checked against the snapshot by ValidateSnapshot.
+func LoadSnapshot(r io.Reader, nodeId string) (*BlockChain, error) {
+	path := fmt.Sprintf(dbPath, nodeId)
+	if DBexists(path) {
+		fmt.Println("Blockchain already exists")
+		runtime.Goexit()
+	}
+
+	decoder := gob.NewDecoder(r)
+
+	var header SnapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	var base Block
+	if err := decoder.Decode(&base); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(base.Hash, header.BlockHash) || base.Height != header.Height {
+		return nil, errors.New("the base block does not match the snapshot header")
+	}
+	if err := Engine.VerifyHeader(&base); err != nil {
+		return nil, err
+	}
+	if hash, ok := Params.Checkpoints[base.Height]; ok && !bytes.Equal(hash, base.Hash) {
+		return nil, fmt.Errorf("block %d does not match the checkpoint %x", base.Height, hash)
+	}
+
+	db, err := OpenDB(path, badger.DefaultOptions(path))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// the entries are committed in batches, the database is deleted if the
+	// snapshot turns out to be invalid
+	fail := func(err error) (*BlockChain, error) {
+		if closeErr := db.Close(); closeErr != nil {
+			log.Panic(closeErr)
+		}
+		if removeErr := os.RemoveAll(path); removeErr != nil {
+			log.Panic(removeErr)
+		}
+		return nil, err
+	}
+
+	stats := UTXOStats{Hash: make([]byte, 32)}
+	batch := db.NewWriteBatch()
+	for i := 0; i < header.Stats.Count; i++ {
+		var snapshotEntry SnapshotEntry
+		if err := decoder.Decode(&snapshotEntry); err != nil {
+			batch.Cancel()
+			return fail(err)
+		}
+		if err := batch.Set(utxoKey(snapshotEntry.Outpoint), snapshotEntry.Entry.Serialize()); err != nil {
+			batch.Cancel()
+			return fail(err)
+		}
+		stats.Add(snapshotEntry.Outpoint, snapshotEntry.Entry)
+	}
+	if err := batch.Flush(); err != nil {
+		return fail(err)
+	}
+
+	if stats.Amount != header.Stats.Amount || !bytes.Equal(stats.Hash, header.Stats.Hash) {
+		return fail(fmt.Errorf("the snapshot entries give the hash %x instead of %x", stats.Hash, header.Stats.Hash))
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(base.Hash, base.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set(utxoStatsKey, stats.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set(utxoTipKey, base.Hash); err != nil {
+			return err
+		}
+		if err := txn.Set(snapshotKey, header.Serialize()); err != nil {
+			return err
+		}
+		return txn.Set([]byte("lh"), base.Hash)
+	}); err != nil {
+		return fail(err)
+	}
+
+	blockchain := BlockChain{base.Hash, db, newUTXOCache()}
+
+	return &blockchain, nil
+}
+
+// Snapshot returns the header of the loaded snapshot whose history is not
+// validated yet
+func (chain *BlockChain) Snapshot() (SnapshotHeader, bool) {
+	var header SnapshotHeader
+	found := false
+
+	if err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(snapshotKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		header = DeserializeSnapshotHeader(v)
+		found = true
+
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	return header, found
+}
+
+// ValidateSnapshot replays the history below the loaded snapshot once it is
+// downloaded and compares the resulting UTXO set with the snapshot hash. It
+// returns false while blocks are missing.
+func (chain *BlockChain) ValidateSnapshot() (bool, error) {
+	header, ok := chain.Snapshot()
+	if !ok {
+		return true, nil
+	}
+
+	var history []*Block
+	for hash := header.BlockHash; len(hash) > 0; {
+		block, err := chain.getBlock(hash)
+		if err != nil {
+			return false, nil
+		}
+		if block.IsPruned() {
+			return false, fmt.Errorf("block %x below the snapshot is pruned", block.Hash)
+		}
+		history = append(history, block)
+		hash = block.PrevHash
+	}
+
+	// the signatures below the last checkpoint are skipped when the history
+	// goes through it, the checkpoint hash is checked below
+	checkpointed := header.Height >= Params.LastCheckpoint()
+
+	UTXO := make(map[Outpoint]UTXOEntry)
+	for i := len(history) - 1; i >= 0; i-- {
+		block := history[i]
+
+		if err := Engine.VerifyHeader(block); err != nil {
+			return false, err
+		}
+		if hash, ok := Params.Checkpoints[block.Height]; ok && !bytes.Equal(hash, block.Hash) {
+			return false, fmt.Errorf("block %d does not match the checkpoint %x", block.Height, hash)
+		}
+
+		// the rules enforced by Connect, and the signatures above the checkpoint
+		var verify func(tx *Transaction, prevOuts map[Outpoint]TxOutput) error
+		if !checkpointed || block.Height > Params.LastCheckpoint() {
+			verify = func(tx *Transaction, prevOuts map[Outpoint]TxOutput) error {
+				if !tx.Verify(prevOuts) {
+					return fmt.Errorf("invalid signature in transaction %x", tx.ID)
+				}
+				return nil
+			}
+		}
+		if _, err := checkBlock(block, func(outpoint Outpoint) (UTXOEntry, bool, error) {
+			entry, ok := UTXO[outpoint]
+			return entry, ok, nil
+		}, verify); err != nil {
+			return false, fmt.Errorf("block %d: %s", block.Height, err)
+		}
+
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() == false {
+				for _, in := range tx.Inputs {
+					delete(UTXO, in.Outpoint())
+				}
+			}
+
+			for outIdx, out := range tx.Outputs {
+				if !IsUnspendable(out.ScriptPubKey) {
+					UTXO[NewOutpoint(tx.ID, outIdx)] = UTXOEntry{out, block.Height, tx.IsCoinbase(), block.Timestamp}
+				}
+			}
+		}
+	}
+
+	stats := UTXOStats{Hash: make([]byte, 32)}
+	for outpoint, entry := range UTXO {
+		stats.Add(outpoint, entry)
+	}
+	if !bytes.Equal(stats.Hash, header.Stats.Hash) {
+		return false, fmt.Errorf("the history gives the UTXO set hash %x instead of %x", stats.Hash, header.Stats.Hash)
+	}
+
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(snapshotKey)
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	return true, nil
+}
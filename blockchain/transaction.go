@@ -2,15 +2,12 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 
 	"github.com/nclv/golang-blockchain/wallet"
@@ -20,6 +17,8 @@ type Transaction struct {
 	ID      []byte
 	Inputs  []TxInput
 	Outputs []TxOutput
+	// height or unix time before which the transaction cannot be mined
+	LockTime int64
 }
 
 func (tx *Transaction) Serialize() []byte {
@@ -45,6 +44,11 @@ func (tx *Transaction) Hash() []byte {
 }
 
 func CoinbaseTx(to, data string) *Transaction {
+	return CoinbaseTxWithFees(to, data, 0)
+}
+
+// CoinbaseTxWithFees pays the subsidy and the fees of the block to to
+func CoinbaseTxWithFees(to, data string, fees int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 24)
 		if _, err := rand.Read(randData); err != nil {
@@ -53,75 +57,171 @@ func CoinbaseTx(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(20, to)
+	txin := TxInput{[]byte{}, -1, []byte(data), SequenceFinal}
+	txout := NewTXOutput(Subsidy+fees, to)
 
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
+	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// NewTransaction sends amount to the address to, the transaction cannot be
+// mined before lockTime when it is not 0
+func NewTransaction(w *wallet.Wallet, to string, amount int, lockTime int64, UTXO *UTXOSet) *Transaction {
+	return NewTransactionOutputs(w, []TxOutput{*NewTXOutput(amount, to)}, 0, lockTime, DefaultCoinSelector, UTXO)
+}
+
+// NewTransactionOutputs funds outputs and fee with the unspent outputs of w
+// chosen by selector, the change is sent back to w unless it is dust
+func NewTransactionOutputs(w *wallet.Wallet, outputs []TxOutput, fee int, lockTime int64, selector CoinSelector, UTXO *UTXOSet) *Transaction {
+	coins := UTXO.WalletCoins(P2PKHScript(wallet.PublicKeyHash(w.PublicKey)))
+	tx := fundTransaction(coins, outputs, fee, lockTime, selector, string(w.Address()))
+	UTXO.BlockChain.SignTransaction(tx, w)
+
+	return tx
+}
+
+// NewAccountTransaction funds outputs and fee with the unspent outputs of all
+// the wallets, each input is signed by the wallet owning the spent output and
+// the change is sent to changeAddress
+func NewAccountTransaction(wallets []*wallet.Wallet, outputs []TxOutput, fee int, lockTime int64, selector CoinSelector, changeAddress string, UTXO *UTXOSet) *Transaction {
+	var coins []Coin
+	for _, w := range wallets {
+		coins = append(coins, UTXO.WalletCoins(P2PKHScript(wallet.PublicKeyHash(w.PublicKey)))...)
+	}
+
+	tx := fundTransaction(coins, outputs, fee, lockTime, selector, changeAddress)
+	prevOuts, err := UTXO.BlockChain.prevOutputs(tx, UTXO.BlockChain.pendingWalletOutputs())
+	if err != nil {
+		log.Panic(err)
+	}
+	tx.SignWithWallets(wallets, prevOuts)
+
+	return tx
+}
+
+// NewUnsignedTransaction funds outputs and fee with the unspent outputs of the
+// address from, the change is sent back to it. It is signed offline.
+func NewUnsignedTransaction(from string, outputs []TxOutput, fee int, lockTime int64, selector CoinSelector, UTXO *UTXOSet) (*Transaction, error) {
+	lockingScript, err := LockingScript(from)
+	if err != nil {
+		return nil, err
+	}
+
+	return fundTransaction(UTXO.WalletCoins(lockingScript), outputs, fee, lockTime, selector, from), nil
+}
+
+// fundTransaction spends the coins chosen by selector to outputs and fee, the
+// change is sent to changeAddress unless it is dust
+func fundTransaction(coins []Coin, outputs []TxOutput, fee int, lockTime int64, selector CoinSelector, changeAddress string) *Transaction {
 	var inputs []TxInput
-	var outputs []TxOutput
 
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	amount := fee
+	for _, out := range outputs {
+		amount += out.Value
+	}
+
+	// at least one output is spent, even by a transaction only carrying data,
+	// the change of the unconfirmed transactions of the wallet can be spent
+	target := amount
+	if target == 0 {
+		target = 1
+	}
+	coins, err := selector.Select(coins, target)
+	if err != nil {
+		log.Panic("Error: ", err)
+	}
 
-	if acc < amount {
-		log.Panic("Error: not enough funds")
+	// the lock time is only enforced if an input is not final
+	sequence := SequenceFinal
+	if lockTime != 0 {
+		sequence = SequenceFinal - 1
 	}
 
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
+	acc := 0
+	for _, coin := range coins {
+		txID, err := hex.DecodeString(coin.Outpoint.ID)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
-			inputs = append(inputs, input)
-		}
+		input := TxInput{txID, coin.Outpoint.Index, nil, sequence}
+		inputs = append(inputs, input)
+		acc += coin.Value
 	}
 
-	from := fmt.Sprintf("%s", w.Address())
-
-	outputs = append(outputs, *NewTXOutput(amount, to))
-
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	outputs = append([]TxOutput{}, outputs...)
+	// a DustThreshold below 1 must not create an empty change output
+	if change := acc - amount; change > 0 && change >= DustThreshold {
+		outputs = append(outputs, *NewTXOutput(change, changeAddress))
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, lockTime}
 	tx.ID = tx.Hash()
-	UTXO.BlockChain.SignTransaction(&tx, w.PrivateKey)
 
 	return &tx
 }
 
+// CheckSanity rejects the transactions whose ID is not their hash, spending an
+// output twice or with data outputs carrying more than MaxDataCarrierSize bytes
+func (tx *Transaction) CheckSanity() error {
+	if !bytes.Equal(tx.ID, transactionID(tx)) {
+		return fmt.Errorf("transaction %x does not match its hash", tx.ID)
+	}
+
+	spent := make(map[Outpoint]bool)
+	for _, in := range tx.Inputs {
+		if spent[in.Outpoint()] {
+			return fmt.Errorf("output %d of transaction %x is spent twice by transaction %x", in.Out, in.ID, tx.ID)
+		}
+		spent[in.Outpoint()] = true
+	}
+
+	for outIdx, out := range tx.Outputs {
+		// OP_RETURN and the longest push of MaxDataCarrierSize bytes
+		if IsUnspendable(out.ScriptPubKey) && len(out.ScriptPubKey) > MaxDataCarrierSize+3 {
+			return fmt.Errorf("data output %d of transaction %x exceeds %d bytes", outIdx, tx.ID, MaxDataCarrierSize)
+		}
+	}
+
+	return nil
+}
+
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
+// transactionID returns the ID of a transaction: the hash of the transaction
+// without its unlocking scripts, with the data of a coinbase
+func transactionID(tx *Transaction) []byte {
+	if tx.IsCoinbase() {
+		return tx.Hash()
+	}
+
+	txCopy := tx.TrimmedCopy()
+	return txCopy.Hash()
+}
+
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.ScriptPubKey})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// Sign unlocks the pay to public key hash outputs spent by tx with the key of w
+func (tx *Transaction) Sign(w *wallet.Wallet, prevOuts map[Outpoint]TxOutput) {
 	// we don't need to sign the coinbase transaction
 	if tx.IsCoinbase() {
 		return
@@ -129,65 +229,71 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 
 	// make sure all inputs are valid
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction does not exist")
+		if _, ok := prevOuts[in.Outpoint()]; !ok {
+			log.Panic("ERROR: Previous output does not exist")
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
+	for inId := range tx.Inputs {
+		tx.SignInput(inId, w, prevOuts, SigHashAll)
+	}
+}
+
+// SignWithWallets unlocks each pay to public key hash output spent by tx with
+// the wallet of its public key hash
+func (tx *Transaction) SignWithWallets(wallets []*wallet.Wallet, prevOuts map[Outpoint]TxOutput) {
+	if tx.IsCoinbase() {
+		return
+	}
 
-	for inId, in := range txCopy.Inputs {
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
+	for inId, in := range tx.Inputs {
+		prevOut, ok := prevOuts[in.Outpoint()]
+		if !ok {
+			log.Panic("ERROR: Previous output does not exist")
+		}
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		if err != nil {
-			log.Panic(err)
+		signed := false
+		for _, w := range wallets {
+			if bytes.Equal(prevOut.ScriptPubKey, P2PKHScript(wallet.PublicKeyHash(w.PublicKey))) {
+				tx.SignInput(inId, w, prevOuts, SigHashAll)
+				signed = true
+				break
+			}
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+		if !signed {
+			log.Panicf("ERROR: No key unlocks input %d", inId)
+		}
+	}
+}
 
-		tx.Inputs[inId].Signature = signature
+// SignInput unlocks the pay to public key hash output spent by the input inId
+// with a signature of hashType, the other inputs are left as they are. The
+// stored public key is pushed, the address of a wallet created before the
+// fixed size encoding is the hash of its shorter key.
+func (tx *Transaction) SignInput(inId int, w *wallet.Wallet, prevOuts map[Outpoint]TxOutput, hashType byte) {
+	signature, err := tx.InputSignature(inId, prevOuts[tx.Inputs[inId].Outpoint()].ScriptPubKey, w.PrivateKey, hashType)
+	if err != nil {
+		log.Panic(err)
 	}
+
+	tx.Inputs[inId].ScriptSig = P2PKHScriptSig(signature, w.PublicKey)
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+// Verify runs the unlocking script of every input against the locking script
+// of the output it spends
+func (tx *Transaction) Verify(prevOuts map[Outpoint]TxOutput) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
 
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("Previous transaction does not exist")
+		if _, ok := prevOuts[in.Outpoint()]; !ok {
+			log.Panic("Previous output does not exist")
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
 	for inId, in := range tx.Inputs {
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
+		if err := ExecuteScript(in.ScriptSig, prevOuts[in.Outpoint()].ScriptPubKey, tx, inId); err != nil {
 			return false
 		}
 	}
@@ -198,19 +304,28 @@ func (tx Transaction) String() string {
 	var lines []string
 
 	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     LockTime:    %d", tx.LockTime))
+	}
 
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:      %x", input.ID))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		if input.Sequence != SequenceFinal {
+			lines = append(lines, fmt.Sprintf("       Sequence:  %x", input.Sequence))
+		}
+		if tx.IsCoinbase() {
+			lines = append(lines, fmt.Sprintf("       Data:      %x", input.ScriptSig))
+		} else {
+			lines = append(lines, fmt.Sprintf("       ScriptSig: %s", DisassembleScript(input.ScriptSig)))
+		}
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:      %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script:    %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script:    %s", DisassembleScript(output.ScriptPubKey)))
 	}
 
 	return strings.Join(lines, "\n")
@@ -2,7 +2,8 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"log"
 
 	"github.com/nclv/golang-blockchain/wallet"
@@ -11,17 +12,19 @@ import (
 type TxInput struct {
 	ID        []byte
 	Out       int
-	Signature []byte
-	PubKey    []byte
+	ScriptSig []byte // unlocking script, the coinbase data for a coinbase input
+	Sequence  uint32 // relative lock, see SequenceLockTimeDisabled
 }
 
-type TxOutputs struct {
-	Outputs []TxOutput
+// Outpoint identifies the output Index of the transaction with the hex encoded ID
+type Outpoint struct {
+	ID    string
+	Index int
 }
 
 type TxOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value        int
+	ScriptPubKey []byte // locking script
 }
 
 func NewTXOutput(value int, address string) *TxOutput {
@@ -31,37 +34,65 @@ func NewTXOutput(value int, address string) *TxOutput {
 	return txo
 }
 
-func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	if err := encoder.Encode(outs); err != nil {
-		log.Panic(err)
+// NewDataOutput anchors data in the chain, the output cannot be spent
+func NewDataOutput(data []byte) (*TxOutput, error) {
+	script, err := DataScript(data)
+	if err != nil {
+		return nil, err
 	}
-	return buffer.Bytes()
+
+	return &TxOutput{0, script}, nil
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	if err := decoder.Decode(&outputs); err != nil {
-		log.Panic(err)
-	}
-	return outputs
+func NewOutpoint(txID []byte, index int) Outpoint {
+	return Outpoint{hex.EncodeToString(txID), index}
 }
 
+func (in *TxInput) Outpoint() Outpoint {
+	return NewOutpoint(in.ID, in.Out)
+}
+
+// UsesKey tells whether the input is unlocked with the key hashed to pubKeyHash
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey)
+	ops, err := ParseScript(in.ScriptSig)
+	if err != nil || len(ops) != 2 {
+		return false
+	}
+	lockingHash := wallet.PublicKeyHash(ops[1].Data)
 
-	return bytes.Compare(lockingHash, pubKeyHash) == 0
+	return bytes.Equal(lockingHash, pubKeyHash)
+}
+
+// LockingScript returns the script locking the outputs sent to address
+func LockingScript(address string) ([]byte, error) {
+	version, payload, err := wallet.DecodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version {
+	case wallet.MultisigVersion:
+		if _, _, ok := ExtractMultisig(payload); !ok {
+			return nil, errors.New("the multisig address does not hold a multisig script")
+		}
+		return payload, nil
+	case wallet.ScriptHashVersion:
+		return P2SHScript(payload), nil
+	default:
+		return P2PKHScript(payload), nil
+	}
 }
 
 func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	// remove version and checksum
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	script, err := LockingScript(string(address))
+	if err != nil {
+		log.Panic(err)
+	}
+	out.ScriptPubKey = script
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	lockingHash, ok := ExtractPubKeyHash(out.ScriptPubKey)
+
+	return ok && bytes.Equal(lockingHash, pubKeyHash)
 }
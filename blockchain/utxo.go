@@ -2,7 +2,11 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/dgraph-io/badger"
@@ -10,7 +14,10 @@ import (
 
 // for BadgerDB ordering
 var (
-	utxoPrefix = []byte("utxo-")
+	// one entry per transaction, the outputs were stored without their index
+	legacyUTXOPrefix = []byte("utxo-")
+	// one entry per output: prefix + transaction ID + big endian output index
+	utxoPrefix = []byte("txo-")
 )
 
 // UTXOSet Unspent transactions outputs set
@@ -18,179 +25,325 @@ type UTXOSet struct {
 	BlockChain *BlockChain
 }
 
+// UTXOEntry is an unspent output with the height and the time of the block
+// that created it
+type UTXOEntry struct {
+	Output   TxOutput
+	Height   int
+	Coinbase bool
+	Time     int64
+}
+
+func (e UTXOEntry) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(e); err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeUTXOEntry(data []byte) UTXOEntry {
+	var entry UTXOEntry
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&entry); err != nil {
+		log.Panic(err)
+	}
+	return entry
+}
+
+func utxoKey(outpoint Outpoint) []byte {
+	txID, err := hex.DecodeString(outpoint.ID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	key := append([]byte{}, utxoPrefix...)
+	key = append(key, txID...)
+	index := make([]byte, 4)
+	binary.BigEndian.PutUint32(index, uint32(outpoint.Index))
+
+	return append(key, index...)
+}
+
+func keyOutpoint(key []byte) Outpoint {
+	key = bytes.TrimPrefix(key, utxoPrefix)
+	index := binary.BigEndian.Uint32(key[len(key)-4:])
+
+	return NewOutpoint(key[:len(key)-4], int(index))
+}
+
+// Migrate replaces the legacy per transaction layout. Its entries lost the
+// output indices so the set is rebuilt from the chain.
+func (u UTXOSet) Migrate() {
+	legacy := false
+
+	if err := u.BlockChain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Seek(legacyUTXOPrefix)
+		legacy = it.ValidForPrefix(legacyUTXOPrefix)
+
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	if legacy {
+		fmt.Println("Migrating the UTXO set to one entry per output")
+		u.DeleteByPrefix(legacyUTXOPrefix)
+		u.Reindex()
+		return
+	}
+
+	if u.hasKey(utxoFlushKey) {
+		fmt.Println("The last UTXO cache flush was interrupted, rebuilding the UTXO set")
+		u.Reindex()
+		return
+	}
+
+	// sets written before the stats and the tip were maintained
+	if !u.hasKey(utxoTipKey) {
+		if err := u.BlockChain.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set(utxoTipKey, u.BlockChain.LastHash)
+		}); err != nil {
+			log.Panic(err)
+		}
+	}
+	if !u.hasKey(utxoStatsKey) {
+		stats := UTXOStats{Hash: make([]byte, 32)}
+		u.ForEach(func(outpoint Outpoint, entry UTXOEntry) {
+			stats.Add(outpoint, entry)
+		})
+		if err := u.BlockChain.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set(utxoStatsKey, stats.Serialize())
+		}); err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// CatchUp connects the blocks added to the chain since the UTXO tip, the set
+// is rebuilt if they cannot be connected
+func (u UTXOSet) CatchUp() {
+	tip, err := u.BlockChain.getBlock(u.BlockChain.LastHash)
+	if err == nil {
+		err = u.SyncTo(tip)
+	}
+	if err != nil {
+		fmt.Printf("The UTXO set cannot follow the tip: %s, rebuilding it\n", err)
+		u.Reindex()
+	}
+}
+
+func (u UTXOSet) hasKey(key []byte) bool {
+	err := u.BlockChain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		return err
+	})
+
+	return err == nil
+}
+
 func (u UTXOSet) Reindex() {
 	db := u.BlockChain.Database
 
+	if u.BlockChain.IsPruned() {
+		log.Panic("The UTXO set cannot be rebuilt from a pruned chain")
+	}
+	if _, ok := u.BlockChain.Snapshot(); ok {
+		log.Panic("The UTXO set cannot be rebuilt before the history of the snapshot is validated")
+	}
+
+	cache := u.BlockChain.utxoCache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.reset()
+
 	u.DeleteByPrefix(utxoPrefix)
 
 	UTXO := u.BlockChain.FindUTXO()
 
 	if err := db.Update(func(txn *badger.Txn) error {
-		for txId, outs := range UTXO {
-			key, err := hex.DecodeString(txId)
-			if err != nil {
-				return err
-			}
-			key = append(utxoPrefix, key...)
-
-			if err := txn.Set(key, outs.Serialize()); err != nil {
+		stats := UTXOStats{Hash: make([]byte, 32)}
+		for outpoint, entry := range UTXO {
+			if err := txn.Set(utxoKey(outpoint), entry.Serialize()); err != nil {
 				return err
 			}
+			stats.Add(outpoint, entry)
 		}
-		return nil
+		if err := txn.Set(utxoStatsKey, stats.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set(utxoTipKey, u.BlockChain.LastHash); err != nil {
+			return err
+		}
+		return txn.Delete(utxoFlushKey)
 	}); err != nil {
 		log.Panic(err)
 	}
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.BlockChain.Database
-
-	if err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					if err != nil {
-						return err
-					}
-					v, err := item.ValueCopy(nil)
-					if err != nil {
-						return err
-					}
-					outs := DeserializeOutputs(v)
-
-					for outIdx, out := range outs.Outputs {
-						// check that output hasn't been spent
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							return err
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							return err
-						}
-					}
-				}
+// Flush writes the cached changes to the database
+func (u UTXOSet) Flush() {
+	cache := u.BlockChain.utxoCache
 
-				newOutputs := TxOutputs{}
-				for _, out := range tx.Outputs {
-					newOutputs.Outputs = append(newOutputs.Outputs, out)
-				}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
 
-				txID := append(utxoPrefix, tx.ID...)
-				if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-					return err
-				}
-			}
-		}
-		return nil
-	}); err != nil {
+	if err := cache.flush(u.BlockChain.Database); err != nil {
 		log.Panic(err)
 	}
 }
 
-func (u UTXOSet) CountTransactions() int {
-	db := u.BlockChain.Database
-	counter := 0
+// Tip returns the hash of the last block applied to the UTXO set
+func (u UTXOSet) Tip() []byte {
+	cache := u.BlockChain.utxoCache
 
-	if err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+	if cache.tip != nil {
+		return cache.tip
+	}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			counter++
+	var tip []byte
+	if err := u.BlockChain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoTipKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
 		}
-
-		return nil
+		tip, err = item.ValueCopy(nil)
+		return err
 	}); err != nil {
 		log.Panic(err)
 	}
 
-	return counter
+	return tip
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
+// GetEntry returns the unspent output referenced by outpoint
+func (u UTXOSet) GetEntry(outpoint Outpoint) (UTXOEntry, error) {
+	cache := u.BlockChain.utxoCache
 
-	db := u.BlockChain.Database
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok, err := cache.get(u.BlockChain.Database, outpoint)
+	if err != nil {
+		return entry, err
+	}
+	if !ok {
+		return entry, fmt.Errorf("output %d of transaction %s is not unspent", outpoint.Index, outpoint.ID)
+	}
+
+	return entry, nil
+}
+
+// iterate calls fn with the unspent entries of the cache, then with the ones
+// of the database it does not shadow, until fn returns false. The database
+// values are only decoded when values is true.
+func (u UTXOSet) iterate(values bool, fn func(outpoint Outpoint, entry UTXOEntry) bool) {
+	cache := u.BlockChain.utxoCache
 
-	if err := db.View(func(txn *badger.Txn) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for outpoint, cached := range cache.entries {
+		if !cached.spent && !fn(outpoint, cached.entry) {
+			return
+		}
+	}
+
+	if err := u.BlockChain.Database.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = values
 
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
 			item := it.Item()
-			v, err := item.ValueCopy(nil)
-			if err != nil {
-				return err
+			outpoint := keyOutpoint(item.Key())
+			if _, ok := cache.entries[outpoint]; ok {
+				continue
 			}
-			outs := DeserializeOutputs(v)
 
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
+			var entry UTXOEntry
+			if values {
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
 				}
+				entry = DeserializeUTXOEntry(v)
+			}
+			if !fn(outpoint, entry) {
+				return nil
 			}
-
 		}
 
 		return nil
 	}); err != nil {
 		log.Panic(err)
 	}
-
-	return UTXOs
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspendOuts := make(map[string][]int)
-	accumulated := 0
+// CountTransactions counts the transactions with at least one unspent output
+func (u UTXOSet) CountTransactions() int {
+	txIDs := make(map[string]bool)
 
-	db := u.BlockChain.Database
+	u.iterate(false, func(outpoint Outpoint, _ UTXOEntry) bool {
+		txIDs[outpoint.ID] = true
+		return true
+	})
 
-	if err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	return len(txIDs)
+}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
+	return u.FindUnspentOutputs(P2PKHScript(pubKeyHash))
+}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			v, err := item.ValueCopy(nil)
-			if err != nil {
-				return err
-			}
+// FindUnspentOutputs returns the unspent outputs locked by script
+func (u UTXOSet) FindUnspentOutputs(script []byte) []TxOutput {
+	var UTXOs []TxOutput
 
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txId := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
+	u.iterate(true, func(_ Outpoint, entry UTXOEntry) bool {
+		if bytes.Equal(entry.Output.ScriptPubKey, script) {
+			UTXOs = append(UTXOs, entry.Output)
+		}
+		return true
+	})
 
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspendOuts[txId] = append(unspendOuts[txId], outIdx)
-				}
-			}
+	return UTXOs
+}
 
-		}
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+	return u.FindSpendableScriptOutputs(P2PKHScript(pubKeyHash), amount)
+}
 
-		return nil
-	}); err != nil {
-		log.Panic(err)
-	}
+// FindSpendableScriptOutputs collects outputs locked by script until their
+// total reaches amount
+func (u UTXOSet) FindSpendableScriptOutputs(script []byte, amount int) (int, map[string][]int) {
+	unspendOuts := make(map[string][]int)
+	accumulated := 0
+
+	u.iterate(true, func(outpoint Outpoint, entry UTXOEntry) bool {
+		if accumulated >= amount {
+			return false
+		}
+		if bytes.Equal(entry.Output.ScriptPubKey, script) {
+			accumulated += entry.Output.Value
+			unspendOuts[outpoint.ID] = append(unspendOuts[outpoint.ID], outpoint.Index)
+		}
+		return true
+	})
 
 	return accumulated, unspendOuts
 }
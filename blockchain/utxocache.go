@@ -0,0 +1,203 @@
+package blockchain
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	// block hash the stored UTXO set corresponds to
+	utxoTipKey = []byte("utxotip")
+	// present while a flush too big for one transaction is written
+	utxoFlushKey = []byte("utxoflush")
+)
+
+// UTXOCacheSize is the memory budget in bytes of the UTXO cache, the cache is
+// flushed to the database once its estimated size exceeds it
+var UTXOCacheSize = 32 << 20
+
+// utxoCache keeps the entries read or written by UTXOSet.Connect in memory and
+// writes them back together with the stats and the tip in one flush
+type utxoCache struct {
+	mutex   sync.Mutex
+	entries map[Outpoint]*cachedEntry
+	stats   *UTXOStats
+	tip     []byte
+	size    int
+	dirty   bool
+}
+
+type cachedEntry struct {
+	entry UTXOEntry
+	spent bool // deleted from the database on flush
+	fresh bool // not in the database, dropped instead of flushed once spent
+	dirty bool
+}
+
+func newUTXOCache() *utxoCache {
+	return &utxoCache{entries: make(map[Outpoint]*cachedEntry)}
+}
+
+func cachedEntrySize(outpoint Outpoint, entry UTXOEntry) int {
+	// map bucket, pointers and struct headers
+	const overhead = 128
+
+	return overhead + len(outpoint.ID) + len(entry.Output.ScriptPubKey)
+}
+
+func (c *utxoCache) loadStats(db *badger.DB) error {
+	if c.stats != nil {
+		return nil
+	}
+
+	return db.View(func(txn *badger.Txn) error {
+		stats, err := getUTXOStats(txn)
+		c.stats = &stats
+		return err
+	})
+}
+
+// get returns the unspent entry of outpoint, reading it from the database
+// into the cache when needed
+func (c *utxoCache) get(db *badger.DB, outpoint Outpoint) (UTXOEntry, bool, error) {
+	if cached, ok := c.entries[outpoint]; ok {
+		return cached.entry, !cached.spent, nil
+	}
+
+	var entry UTXOEntry
+	found := false
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoKey(outpoint))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		entry = DeserializeUTXOEntry(v)
+		found = true
+
+		return nil
+	}); err != nil {
+		return entry, false, err
+	}
+
+	if found {
+		c.entries[outpoint] = &cachedEntry{entry: entry}
+		c.size += cachedEntrySize(outpoint, entry)
+	}
+
+	return entry, found, nil
+}
+
+func (c *utxoCache) add(outpoint Outpoint, entry UTXOEntry) {
+	cached, ok := c.entries[outpoint]
+	if !ok {
+		// the output may still exist in the database if a spend of it was not flushed
+		cached = &cachedEntry{fresh: true}
+		c.entries[outpoint] = cached
+		c.size += cachedEntrySize(outpoint, entry)
+	}
+	cached.entry = entry
+	cached.spent = false
+	cached.dirty = true
+	c.dirty = true
+}
+
+func (c *utxoCache) spend(outpoint Outpoint) {
+	cached := c.entries[outpoint]
+	if cached.fresh {
+		delete(c.entries, outpoint)
+		c.size -= cachedEntrySize(outpoint, cached.entry)
+		return
+	}
+	cached.spent = true
+	cached.dirty = true
+	c.dirty = true
+}
+
+// flush writes the dirty entries, the stats and the tip then empties the cache
+func (c *utxoCache) flush(db *badger.DB) error {
+	if !c.dirty {
+		c.entries = make(map[Outpoint]*cachedEntry)
+		c.size = 0
+		return nil
+	}
+
+	txn := db.NewTransaction(true)
+	defer func() {
+		txn.Discard()
+	}()
+
+	write := func(op func(txn *badger.Txn) error) error {
+		err := op(txn)
+		if !errors.Is(err, badger.ErrTxnTooBig) {
+			return err
+		}
+		// the flush is split, the marker stays until its last part is committed
+		if err := txn.Commit(); err != nil {
+			return err
+		}
+		txn = db.NewTransaction(true)
+
+		return op(txn)
+	}
+
+	if err := txn.Set(utxoFlushKey, []byte{1}); err != nil {
+		return err
+	}
+
+	for outpoint, cached := range c.entries {
+		if !cached.dirty {
+			continue
+		}
+
+		key := utxoKey(outpoint)
+		var err error
+		if cached.spent {
+			err = write(func(txn *badger.Txn) error { return txn.Delete(key) })
+		} else {
+			value := cached.entry.Serialize()
+			err = write(func(txn *badger.Txn) error { return txn.Set(key, value) })
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := write(func(txn *badger.Txn) error {
+		if err := txn.Set(utxoStatsKey, c.stats.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set(utxoTipKey, c.tip); err != nil {
+			return err
+		}
+		return txn.Delete(utxoFlushKey)
+	}); err != nil {
+		return err
+	}
+
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	c.entries = make(map[Outpoint]*cachedEntry)
+	c.size = 0
+	c.dirty = false
+
+	return nil
+}
+
+// reset drops the cache after the stored set was rewritten
+func (c *utxoCache) reset() {
+	c.entries = make(map[Outpoint]*cachedEntry)
+	c.stats = nil
+	c.tip = nil
+	c.size = 0
+	c.dirty = false
+}
@@ -0,0 +1,164 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+var utxoStatsKey = []byte("utxostats")
+
+// 2^256, the multiset hash is the sum of the entry hashes modulo this value
+var statsModulus = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// UTXOStats summarizes the UTXO set, Hash is a multiset hash so it does not
+// depend on the order the entries were added or removed
+type UTXOStats struct {
+	Count  int
+	Amount int
+	Hash   []byte
+}
+
+func entryHash(outpoint Outpoint, entry UTXOEntry) *big.Int {
+	data := append(utxoKey(outpoint), entry.Serialize()...)
+	hash := sha256.Sum256(data)
+
+	return new(big.Int).SetBytes(hash[:])
+}
+
+func (s *UTXOStats) apply(outpoint Outpoint, entry UTXOEntry, add bool) {
+	sum := new(big.Int).SetBytes(s.Hash)
+
+	if add {
+		sum.Add(sum, entryHash(outpoint, entry))
+		s.Count++
+		s.Amount += entry.Output.Value
+	} else {
+		sum.Sub(sum, entryHash(outpoint, entry))
+		s.Count--
+		s.Amount -= entry.Output.Value
+	}
+	sum.Mod(sum, statsModulus)
+
+	hash := make([]byte, 32)
+	s.Hash = sum.FillBytes(hash)
+}
+
+func (s *UTXOStats) Add(outpoint Outpoint, entry UTXOEntry) {
+	s.apply(outpoint, entry, true)
+}
+
+func (s *UTXOStats) Remove(outpoint Outpoint, entry UTXOEntry) {
+	s.apply(outpoint, entry, false)
+}
+
+func (s UTXOStats) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(s); err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeUTXOStats(data []byte) UTXOStats {
+	var stats UTXOStats
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&stats); err != nil {
+		log.Panic(err)
+	}
+	return stats
+}
+
+func getUTXOStats(txn *badger.Txn) (UTXOStats, error) {
+	item, err := txn.Get(utxoStatsKey)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return UTXOStats{Hash: make([]byte, 32)}, nil
+	} else if err != nil {
+		return UTXOStats{}, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return UTXOStats{}, err
+	}
+
+	return DeserializeUTXOStats(v), nil
+}
+
+// Stats returns the summary maintained on every update of the UTXO set
+func (u UTXOSet) Stats() UTXOStats {
+	cache := u.BlockChain.utxoCache
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.loadStats(u.BlockChain.Database); err != nil {
+		log.Panic(err)
+	}
+
+	return *cache.stats
+}
+
+// ForEach calls fn with every entry of the UTXO set, the cached ones first and
+// then the stored ones in key order. fn cannot use the UTXO set.
+func (u UTXOSet) ForEach(fn func(outpoint Outpoint, entry UTXOEntry)) {
+	u.iterate(true, func(outpoint Outpoint, entry UTXOEntry) bool {
+		fn(outpoint, entry)
+		return true
+	})
+}
+
+// Verify recomputes the UTXO set from the chain and reports every difference
+// with the stored set and its stats
+func (u UTXOSet) Verify() []string {
+	var mismatches []string
+
+	if u.BlockChain.IsPruned() {
+		log.Panic("The UTXO set cannot be recomputed from a pruned chain")
+	}
+	if _, ok := u.BlockChain.Snapshot(); ok {
+		log.Panic("The UTXO set cannot be recomputed before the history of the snapshot is validated")
+	}
+
+	expected := u.BlockChain.FindUTXO()
+	expectedStats := UTXOStats{Hash: make([]byte, 32)}
+	for outpoint, entry := range expected {
+		expectedStats.Add(outpoint, entry)
+	}
+
+	seen := make(map[Outpoint]bool)
+	u.ForEach(func(outpoint Outpoint, entry UTXOEntry) {
+		seen[outpoint] = true
+
+		want, ok := expected[outpoint]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("extra output %s:%d", outpoint.ID, outpoint.Index))
+		} else if !bytes.Equal(entry.Serialize(), want.Serialize()) {
+			mismatches = append(mismatches, fmt.Sprintf("different output %s:%d", outpoint.ID, outpoint.Index))
+		}
+	})
+
+	var missing []string
+	for outpoint := range expected {
+		if !seen[outpoint] {
+			missing = append(missing, fmt.Sprintf("missing output %s:%d", outpoint.ID, outpoint.Index))
+		}
+	}
+	sort.Strings(missing)
+	mismatches = append(mismatches, missing...)
+
+	stats := u.Stats()
+	if stats.Count != expectedStats.Count || stats.Amount != expectedStats.Amount || !bytes.Equal(stats.Hash, expectedStats.Hash) {
+		mismatches = append(mismatches, fmt.Sprintf("stats are %d outputs, amount %d, hash %x but the chain gives %d outputs, amount %d, hash %x",
+			stats.Count, stats.Amount, stats.Hash, expectedStats.Count, expectedStats.Amount, expectedStats.Hash))
+	}
+
+	return mismatches
+}
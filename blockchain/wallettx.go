@@ -0,0 +1,170 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dgraph-io/badger"
+)
+
+// transactions sent by the wallets of the node, kept to bump their fee
+var walletTxPrefix = []byte("wtx-")
+
+func walletTxKey(txID []byte) []byte {
+	return append(append([]byte{}, walletTxPrefix...), txID...)
+}
+
+// SaveWalletTx keeps a transaction sent by a wallet of the node
+func (chain *BlockChain) SaveWalletTx(tx *Transaction) {
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(walletTxKey(tx.ID), tx.Serialize())
+	}); err != nil {
+		log.Panic(err)
+	}
+}
+
+// WalletTx returns a transaction sent by a wallet of the node
+func (chain *BlockChain) WalletTx(txID []byte) (*Transaction, error) {
+	var tx Transaction
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(walletTxKey(txID))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return fmt.Errorf("transaction %x was not sent by our wallets", txID)
+		} else if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		tx = DeserializeTransaction(v)
+		return nil
+	})
+
+	return &tx, err
+}
+
+// DeleteWalletTx forgets a transaction replaced by another one
+func (chain *BlockChain) DeleteWalletTx(txID []byte) {
+	if err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(walletTxKey(txID))
+	}); err != nil {
+		log.Panic(err)
+	}
+}
+
+// PendingWalletTxs returns the transactions sent by the wallets of the node
+// that are not confirmed yet, parents first. A transaction whose inputs are
+// neither unspent nor created by another pending transaction was confirmed or
+// replaced, it is deleted.
+func (chain *BlockChain) PendingWalletTxs() []*Transaction {
+	pending := make(map[string]*Transaction)
+
+	if err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(walletTxPrefix); it.ValidForPrefix(walletTxPrefix); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			tx := DeserializeTransaction(v)
+			pending[hex.EncodeToString(tx.ID)] = &tx
+		}
+
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	UTXOSet := UTXOSet{chain}
+	for changed := true; changed; {
+		changed = false
+		for id, tx := range pending {
+			for _, in := range tx.Inputs {
+				if parent, ok := pending[hex.EncodeToString(in.ID)]; ok && in.Out < len(parent.Outputs) {
+					continue
+				}
+				if _, err := UTXOSet.GetEntry(in.Outpoint()); err == nil {
+					continue
+				}
+				chain.DeleteWalletTx(tx.ID)
+				delete(pending, id)
+				changed = true
+				break
+			}
+		}
+	}
+
+	var txs []*Transaction
+	added := make(map[string]bool)
+	var add func(tx *Transaction)
+	add = func(tx *Transaction) {
+		id := hex.EncodeToString(tx.ID)
+		if added[id] {
+			return
+		}
+		added[id] = true
+		for _, in := range tx.Inputs {
+			if parent, ok := pending[hex.EncodeToString(in.ID)]; ok {
+				add(parent)
+			}
+		}
+		txs = append(txs, tx)
+	}
+	for _, tx := range pending {
+		add(tx)
+	}
+
+	return txs
+}
+
+// pendingWalletOutputs returns the outputs created by the pending transactions
+// of our wallets
+func (chain *BlockChain) pendingWalletOutputs() map[Outpoint]TxOutput {
+	outputs := make(map[Outpoint]TxOutput)
+	for _, tx := range chain.PendingWalletTxs() {
+		for outIdx, out := range tx.Outputs {
+			outputs[NewOutpoint(tx.ID, outIdx)] = out
+		}
+	}
+
+	return outputs
+}
+
+// WalletCoins returns the outputs locked by script in the UTXO set and in the
+// pending transactions of our wallets. The outputs these transactions spend
+// are skipped.
+func (u UTXOSet) WalletCoins(script []byte) []Coin {
+	var coins []Coin
+
+	pending := u.BlockChain.PendingWalletTxs()
+	spent := make(map[Outpoint]bool)
+	for _, tx := range pending {
+		for _, in := range tx.Inputs {
+			spent[in.Outpoint()] = true
+		}
+	}
+
+	collect := func(outpoint Outpoint, out TxOutput) {
+		if !spent[outpoint] && bytes.Equal(out.ScriptPubKey, script) {
+			coins = append(coins, Coin{outpoint, out.Value})
+		}
+	}
+
+	u.ForEach(func(outpoint Outpoint, entry UTXOEntry) {
+		collect(outpoint, entry.Output)
+	})
+	for _, tx := range pending {
+		for outIdx, out := range tx.Outputs {
+			collect(NewOutpoint(tx.ID, outIdx), out)
+		}
+	}
+
+	return coins
+}
@@ -1,14 +1,22 @@
 package cli
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
-
-	"github.com/dgraph-io/badger"
+	"strings"
+	"time"
 
 	"github.com/nclv/golang-blockchain/blockchain"
 	"github.com/nclv/golang-blockchain/network"
@@ -22,21 +30,116 @@ func (cli *CommandLine) PrintUsage() {
 	fmt.Println(" getbalance -address ADDRESS - get the balance for the address")
 	fmt.Println(" createblockchain -address ADDRESS - creates a blockchain and send genesis reward to address")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send an amount of coins. Then -mine flag is set.")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT -fee FEE -locktime HEIGHT|UNIX -data HEX -coinselect bnb|largest|smallest|random -dust AMOUNT -mine - Send an amount of coins. Then -mine flag is set. The transaction cannot be mined before -locktime, -data is carried in an unspendable output, -coinselect chooses the spent outputs, a change below -dust is left as fee")
+	fmt.Println(" sendmany -from FROM -to ADDRESS:AMOUNT,... -file FILE -fee FEE -coinselect bnb|largest|smallest|random -dust AMOUNT -mine - Send to several addresses in one transaction, the payments are given with -to or in a JSON or CSV FILE, a change below -dust is left as fee")
+	fmt.Println(" accountsend -to TO -amount AMOUNT -fee FEE -coinselect bnb|largest|smallest|random -dust AMOUNT -mine -miner ADDRESS - Send an amount of coins from all the addresses of the wallet file, the change goes to a new address unless it is below -dust, -mine rewards the -miner address")
+	fmt.Println(" bumpfee -txid TXID -fee FEE - Replaces an unconfirmed transaction of our wallets with one paying a higher fee")
+	fmt.Println(" anchor -from FROM -file PATH -mine - Records the SHA256 hash of a file in the chain")
+	fmt.Println(" findanchor -data HEX | -file PATH - Prints the block containing the anchored data or file hash")
 	fmt.Println(" createwallet - Creates a new Wallet")
 	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
+	fmt.Println(" getpubkey -address ADDRESS - Prints the public key of an address of our wallet file")
+	fmt.Println(" createmultisig -required M -pubkeys PUBKEY,PUBKEY - Creates an address spendable with M signatures of the public keys")
+	fmt.Println(" createmultisigtx -from MULTISIG -to TO -amount AMOUNT -redeemscript SCRIPT -file FILE - Writes an unsigned transaction spending from a multisig address, -redeemscript is needed for a pay to script hash address")
+	fmt.Println(" signmultisigtx -address ADDRESS -file FILE - Adds the signatures of an address of our wallet file to the transaction")
+	fmt.Println(" sendmultisigtx -file FILE - Sends the transaction once enough signatures are collected")
+	fmt.Println(" createpsbt -from FROM -to TO -amount AMOUNT -fee FEE -coinselect bnb|largest|smallest|random -redeemscript SCRIPT -file FILE - Writes a partially signed transaction with the transactions it spends, -redeemscript is needed for a pay to script hash address")
+	fmt.Println(" signpsbt -address ADDRESS -sighash TYPE -file FILE - Signs the inputs of the partially signed transaction unlocked by an address of our wallet file, the chain is not needed")
+	fmt.Println(" finalizepsbt -file FILE -out FILE - Writes the transaction once every input is signed")
+	fmt.Println(" broadcast -file FILE - Sends a finalized transaction")
+	fmt.Println(" createhtlc -from FROM -to TO -amount AMOUNT -locktime HEIGHT|UNIX -hash HASH -mine - Locks an amount claimable by TO with the secret hashed to HASH, or refunded to FROM after -locktime. A secret is generated without -hash")
+	fmt.Println(" claimhtlc -address ADDRESS -redeemscript SCRIPT -secret SECRET -mine - Claims the outputs of a contract with its secret")
+	fmt.Println(" refundhtlc -address ADDRESS -redeemscript SCRIPT -mine - Takes back the outputs of a contract after its lock time")
+	fmt.Println(" gethtlcsecret -redeemscript SCRIPT - Prints the secret revealed by the claim of a contract")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" gettxoutsetinfo - Prints the number of unspent outputs, their total amount and the UTXO set hash")
+	fmt.Println(" verifyutxo - Recomputes the UTXO set from the chain and reports the mismatches")
+	fmt.Println(" dumputxo -file FILE - Writes a snapshot of the UTXO set at the tip block")
+	fmt.Println(" loadutxo -file FILE - Creates the blockchain from a UTXO snapshot, the history is synced and validated afterwards")
+	fmt.Println(" startnode -miner ADDRESS -work ADDR -prune DEPTH -utxocache MB -minfeerate RATE - Start a node with ID specified in NODE_ID env. var. -miner enables mining, -work serves the RPC to external miners and wallets, getwork needs -miner, -prune deletes the block bodies deeper than DEPTH, -utxocache sets the UTXO cache budget, -minfeerate is the lowest fee per 1000 bytes of the mined transactions with their unconfirmed ancestors")
+	fmt.Println(" miner -work ADDR -threads N - Mine with the templates of the work server of a node")
+	fmt.Println(" mininginfo -blocks N -work ADDR - Prints the difficulty and the hashrates over the last N blocks, -work queries a running node")
+	fmt.Println(" estimatefee -blocks N -work ADDR - Prints the fee per 1000 bytes for a confirmation within N blocks, -work queries a running node")
+}
+
+func (cli *CommandLine) PrintConsensusUsage() {
+	fmt.Println("Consensus (env. var.):")
+	fmt.Println(" CONSENSUS=pow|poa - Consensus engine, proof of work by default")
+	fmt.Println(" POA_SIGNERS=PUBKEY,PUBKEY - Hex public keys of the proof of authority signers in rotation order")
+	fmt.Println(" CHECKPOINTS=HEIGHT:HASH,HEIGHT:HASH - Checkpoints added to the hard-coded ones")
+}
+
+// ConfigureCheckpoints adds the checkpoints of the environment to the chain params
+func (cli *CommandLine) ConfigureCheckpoints() {
+	for _, checkpoint := range strings.Split(os.Getenv("CHECKPOINTS"), ",") {
+		if checkpoint == "" {
+			continue
+		}
+
+		parts := strings.Split(checkpoint, ":")
+		if len(parts) != 2 {
+			log.Panicf("Invalid checkpoint %q, expected HEIGHT:HASH", checkpoint)
+		}
+		height, err := strconv.Atoi(parts[0])
+		if err != nil {
+			log.Panic(err)
+		}
+		hash, err := hex.DecodeString(parts[1])
+		if err != nil {
+			log.Panic(err)
+		}
+
+		blockchain.Params.AddCheckpoint(height, hash)
+	}
+}
+
+// ConfigureConsensus selects the consensus engine from the environment, the
+// key of signerAddress is used to seal blocks when it is a proof of authority signer
+func (cli *CommandLine) ConfigureConsensus(nodeID, signerAddress string) {
+	switch os.Getenv("CONSENSUS") {
+	case "", "pow":
+		blockchain.Engine = &blockchain.PowEngine{}
+	case "poa":
+		var signers [][]byte
+		for _, pubKey := range strings.Split(os.Getenv("POA_SIGNERS"), ",") {
+			if pubKey == "" {
+				continue
+			}
+			signer, err := hex.DecodeString(pubKey)
+			if err != nil {
+				log.Panic(err)
+			}
+			signers = append(signers, signer)
+		}
+		if len(signers) == 0 {
+			log.Panic("POA_SIGNERS env is not set!")
+		}
+
+		var key *ecdsa.PrivateKey
+		if len(signerAddress) > 0 {
+			wallets, err := wallet.CreateWallets(nodeID)
+			if err == nil {
+				if w, ok := wallets.Wallets[signerAddress]; ok {
+					key = &w.PrivateKey
+				}
+			}
+		}
+		blockchain.Engine = blockchain.NewPoAEngine(signers, key)
+	default:
+		cli.PrintConsensusUsage()
+		runtime.Goexit()
+	}
 }
 
 func (cli *CommandLine) ValidateArgs() {
 	if len(os.Args) < 2 {
 		cli.PrintUsage()
+		cli.PrintConsensusUsage()
 		runtime.Goexit()
 	}
 }
 
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
+func (cli *CommandLine) StartNode(nodeID, minerAddress, workAddress string, prune int) {
 	fmt.Printf("Starting Node %s\n", nodeID)
 
 	if len(minerAddress) > 0 {
@@ -46,7 +149,89 @@ func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	network.StartServer(nodeID, minerAddress)
+	cli.ConfigureConsensus(nodeID, minerAddress)
+	if prune > 0 && prune < blockchain.MinPruneDepth {
+		log.Panicf("The prune depth must be at least %d blocks", blockchain.MinPruneDepth)
+	}
+	network.StartServer(nodeID, minerAddress, workAddress, prune)
+}
+
+func (cli *CommandLine) Miner(workAddress string, threads int) {
+	network.StartMiner(workAddress, threads)
+}
+
+func (cli *CommandLine) MiningInfo(nodeID string, blocks int, workAddress string) {
+	var info blockchain.MiningInfo
+
+	if len(workAddress) > 0 {
+		client, err := network.DialWork(workAddress)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = client.Call("getmininginfo", network.MiningInfoParams{Blocks: blocks}, &info)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := client.Close(); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		cli.ConfigureConsensus(nodeID, "")
+		chain := blockchain.ContinueBlockChain(nodeID)
+		defer func(chain *blockchain.BlockChain) {
+			err := chain.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(chain)
+
+		info = chain.MiningInfo(blocks)
+	}
+
+	fmt.Printf("Height: %d\n", info.Height)
+	fmt.Printf("Difficulty: %d\n", info.Difficulty)
+	fmt.Printf("Target: %064s\n", info.Target)
+	fmt.Printf("Average block interval (last %d blocks): %.2f s\n", info.Blocks, info.AvgInterval)
+	fmt.Printf("Network hashrate: %.2f H/s\n", info.NetworkHashrate)
+	if info.Mining {
+		fmt.Printf("Local hashrate: %.2f H/s\n", info.LocalHashrate)
+	} else {
+		fmt.Println("Local hashrate: not mining")
+	}
+}
+
+func (cli *CommandLine) EstimateFee(nodeID string, blocks int, workAddress string) {
+	var estimate blockchain.FeeEstimate
+
+	if len(workAddress) > 0 {
+		client, err := network.DialWork(workAddress)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = client.Call("estimatefee", network.EstimateFeeParams{Blocks: blocks}, &estimate)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := client.Close(); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		chain := blockchain.ContinueBlockChain(nodeID)
+		defer func(chain *blockchain.BlockChain) {
+			err := chain.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(chain)
+
+		estimate = chain.FeeStats().Estimate(blocks)
+	}
+
+	if estimate.Fallback {
+		fmt.Printf("Not enough confirmed transactions, fallback fee rate: %d per 1000 bytes\n", estimate.FeeRate)
+		return
+	}
+	fmt.Printf("Fee rate for a confirmation within %d blocks: %d per 1000 bytes\n", estimate.Blocks, estimate.FeeRate)
 }
 
 func (cli *CommandLine) ListAddresses(nodeID string) {
@@ -58,6 +243,387 @@ func (cli *CommandLine) ListAddresses(nodeID string) {
 	}
 }
 
+func (cli *CommandLine) GetPubKey(address, nodeID string) {
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("Address is not in the wallet file")
+	}
+
+	fmt.Printf("%x\n", w.PublicKey)
+}
+
+func (cli *CommandLine) CreateMultisig(required int, pubKeys string) {
+	var keys [][]byte
+	for _, pubKey := range strings.Split(pubKeys, ",") {
+		key, err := hex.DecodeString(pubKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		keys = append(keys, key)
+	}
+
+	script, err := blockchain.MultisigScript(required, keys)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	address, err := blockchain.ScriptHashAddress(script)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Multisig address: %s\n", blockchain.MultisigAddress(script))
+	fmt.Printf("Pay to script hash address: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", script)
+	fmt.Printf("Script: %s\n", blockchain.DisassembleScript(script))
+}
+
+func (cli *CommandLine) CreateMultisigTx(from, to string, amount int, redeemScript, file, nodeID string) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("Address is not valid")
+	}
+	if !wallet.ValidateAddress(to) {
+		log.Panic("Address is not valid")
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	redeem, err := hex.DecodeString(redeemScript)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	mtx := blockchain.NewMultisigTransaction(from, to, amount, redeem, &UTXOSet)
+	if err := ioutil.WriteFile(file, mtx.Serialize(), 0644); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Transaction %x needs %d signatures\n", mtx.Tx.ID, mtx.Missing())
+}
+
+func (cli *CommandLine) SignMultisigTx(address, file, nodeID string) {
+	mtx := readMultisigTx(file)
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("Address is not in the wallet file")
+	}
+
+	if err := mtx.Sign(w); err != nil {
+		log.Panic(err)
+	}
+	if err := ioutil.WriteFile(file, mtx.Serialize(), 0644); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Signed, %d signatures are missing\n", mtx.Missing())
+}
+
+func (cli *CommandLine) SendMultisigTx(file string) {
+	mtx := readMultisigTx(file)
+
+	tx, err := mtx.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	network.SendTx(network.KnownNodes[0], tx)
+	fmt.Println("Send tx")
+}
+
+// CreateHTLC locks amount to a contract claimable by to with the secret hashed
+// to hash, or refunded to from after lockTime. A secret is generated if no
+// hash is given.
+func (cli *CommandLine) CreateHTLC(from, to string, amount int, hash string, lockTime int64, nodeID string, mineNow bool) {
+	var secret, secretHash []byte
+	if hash == "" {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Panic(err)
+		}
+		sum := sha256.Sum256(secret)
+		secretHash = sum[:]
+	} else {
+		var err error
+		if secretHash, err = hex.DecodeString(hash); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	htlc, err := blockchain.NewHTLC(secretHash, to, from, lockTime)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if mineNow {
+		cli.ConfigureConsensus(nodeID, from)
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w := wallets.GetWallet(from)
+
+	address, err := htlc.Address()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tx := blockchain.NewTransaction(&w, address, amount, 0, &UTXOSet)
+	submitTx(chain, tx, from, mineNow)
+
+	if secret != nil {
+		fmt.Printf("Secret: %x\n", secret)
+	}
+	fmt.Printf("Hash: %x\n", secretHash)
+	fmt.Printf("Contract address: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", htlc.Script())
+	fmt.Printf("Script: %s\n", blockchain.DisassembleScript(htlc.Script()))
+}
+
+// ClaimHTLC spends the outputs of a contract to its recipient address with
+// the secret
+func (cli *CommandLine) ClaimHTLC(address, redeemScript, secret, nodeID string, mineNow bool) {
+	redeem, err := hex.DecodeString(redeemScript)
+	if err != nil {
+		log.Panic(err)
+	}
+	preimage, err := hex.DecodeString(secret)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	cli.spendHTLC(address, nodeID, mineNow, func(w *wallet.Wallet, UTXOSet *blockchain.UTXOSet) (*blockchain.Transaction, error) {
+		return blockchain.NewHTLCClaim(w, redeem, preimage, UTXOSet)
+	})
+}
+
+// RefundHTLC spends the outputs of a contract back to its sender address once
+// the lock time is reached
+func (cli *CommandLine) RefundHTLC(address, redeemScript, nodeID string, mineNow bool) {
+	redeem, err := hex.DecodeString(redeemScript)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	cli.spendHTLC(address, nodeID, mineNow, func(w *wallet.Wallet, UTXOSet *blockchain.UTXOSet) (*blockchain.Transaction, error) {
+		return blockchain.NewHTLCRefund(w, redeem, UTXOSet)
+	})
+}
+
+func (cli *CommandLine) spendHTLC(address, nodeID string, mineNow bool, newTx func(*wallet.Wallet, *blockchain.UTXOSet) (*blockchain.Transaction, error)) {
+	if mineNow {
+		cli.ConfigureConsensus(nodeID, address)
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("Address is not in the wallet file")
+	}
+
+	tx, err := newTx(w, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	submitTx(chain, tx, address, mineNow)
+
+	fmt.Println("Success!")
+}
+
+// GetHTLCSecret prints the secret revealed by the claim of a contract, to
+// claim the other side of a swap
+func (cli *CommandLine) GetHTLCSecret(redeemScript, nodeID string) {
+	redeem, err := hex.DecodeString(redeemScript)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	secret, err := chain.FindHTLCSecret(redeem)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Secret: %x\n", secret)
+}
+
+func (cli *CommandLine) CreatePSBT(from, to string, amount, fee int, coinSelect, redeemScript, file, nodeID string) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("Address is not valid")
+	}
+	if !wallet.ValidateAddress(to) {
+		log.Panic("Address is not valid")
+	}
+	selector, ok := blockchain.CoinSelectors[coinSelect]
+	if !ok {
+		log.Panicf("Unknown coin selection %s", coinSelect)
+	}
+	redeem, err := hex.DecodeString(redeemScript)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	outputs := []blockchain.TxOutput{*blockchain.NewTXOutput(amount, to)}
+	tx, err := blockchain.NewUnsignedTransaction(from, outputs, fee, 0, selector, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	psbt, err := blockchain.NewPSBT(tx, redeem, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := ioutil.WriteFile(file, psbt.Serialize(), 0644); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Transaction %x spends %d outputs\n", tx.ID, len(tx.Inputs))
+}
+
+// SignPSBT only reads the wallet file, the spent transactions are in the file
+func (cli *CommandLine) SignPSBT(address, sigHash, file, nodeID string) {
+	psbt := readPSBT(file)
+
+	hashType, ok := blockchain.SigHashTypes[strings.ToUpper(sigHash)]
+	if !ok {
+		log.Panicf("Unknown signature hash type %s", sigHash)
+	}
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("Address is not in the wallet file")
+	}
+
+	// what is signed
+	for outIdx, out := range psbt.Tx.Outputs {
+		fmt.Printf("Output %d: %d to %s\n", outIdx, out.Value, blockchain.DisassembleScript(out.ScriptPubKey))
+	}
+	fee, err := psbt.Fee()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Fee: %d\n", fee)
+
+	signed, err := psbt.Sign(w, hashType)
+	if err != nil {
+		log.Panic(err)
+	}
+	if signed == 0 {
+		log.Panic("The address does not unlock any input")
+	}
+	if err := ioutil.WriteFile(file, psbt.Serialize(), 0644); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Signed %d inputs, %d inputs are missing signatures\n", signed, psbt.Missing())
+}
+
+func (cli *CommandLine) FinalizePSBT(file, out string) {
+	psbt := readPSBT(file)
+
+	tx, err := psbt.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := ioutil.WriteFile(out, tx.Serialize(), 0644); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Transaction %x is complete\n", tx.ID)
+}
+
+func (cli *CommandLine) Broadcast(file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx := blockchain.DeserializeTransaction(data)
+
+	network.SendTx(network.KnownNodes[0], &tx)
+	fmt.Println("Send tx")
+}
+
+func readPSBT(file string) *blockchain.PSBT {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	psbt, err := blockchain.DeserializePSBT(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return psbt
+}
+
+func readMultisigTx(file string) *blockchain.MultisigTx {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	mtx, err := blockchain.DeserializeMultisigTx(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return mtx
+}
+
 func (cli *CommandLine) CreateWallet(nodeID string) {
 	wallets, _ := wallet.CreateWallets(nodeID)
 	address := wallets.AddWallet()
@@ -66,131 +632,576 @@ func (cli *CommandLine) CreateWallet(nodeID string) {
 	fmt.Printf("New address is: %s\n", address)
 }
 
-func (cli *CommandLine) ReindexUTXO(nodeID string) {
+func (cli *CommandLine) ReindexUTXO(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	UTXOSet.Reindex()
+
+	count := UTXOSet.CountTransactions()
+	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+}
+
+func (cli *CommandLine) GetTxOutSetInfo(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	stats := UTXOSet.Stats()
+
+	fmt.Printf("Best block: %x\n", chain.LastHash)
+	fmt.Printf("Height: %d\n", chain.GetBestHeight())
+	fmt.Printf("Transactions: %d\n", UTXOSet.CountTransactions())
+	fmt.Printf("Outputs: %d\n", stats.Count)
+	fmt.Printf("Total amount: %d\n", stats.Amount)
+	fmt.Printf("Hash: %x\n", stats.Hash)
+	if snapshot, ok := chain.Snapshot(); ok {
+		fmt.Printf("Loaded from a snapshot at height %d, history not validated yet\n", snapshot.Height)
+	}
+}
+
+func (cli *CommandLine) DumpUTXO(nodeID, file string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	f, err := os.Create(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func(f *os.File) {
+		err := f.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(f)
+
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	header, err := UTXOSet.Dump(f)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Dumped %d outputs at block %x (height %d)\n", header.Stats.Count, header.BlockHash, header.Height)
+	fmt.Printf("Hash: %x\n", header.Stats.Hash)
+}
+
+func (cli *CommandLine) LoadUTXO(nodeID, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func(f *os.File) {
+		err := f.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(f)
+
+	cli.ConfigureConsensus(nodeID, "")
+	chain, err := blockchain.LoadSnapshot(f, nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	header, _ := chain.Snapshot()
+	fmt.Printf("Loaded %d outputs at block %x (height %d)\n", header.Stats.Count, header.BlockHash, header.Height)
+	fmt.Println("The history is validated once it is synced with startnode")
+}
+
+func (cli *CommandLine) VerifyUTXO(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	mismatches := UTXOSet.Verify()
+
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	if len(mismatches) > 0 {
+		fmt.Printf("The UTXO set has %d mismatches, run reindexutxo to rebuild it\n", len(mismatches))
+	} else {
+		fmt.Println("The UTXO set matches the chain")
+	}
+}
+
+func (cli *CommandLine) PrintChain(nodeID string) {
+	cli.ConfigureConsensus(nodeID, "")
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	iter := chain.Iterator()
+	for {
+		block := iter.Next()
+
+		fmt.Printf("Previous Hash: %x\n", block.PrevHash)
+		fmt.Printf("Hash: %x\n", block.Hash)
+		if block.IsPruned() {
+			fmt.Println("Transactions: pruned")
+		}
+
+		err := blockchain.Engine.VerifyHeader(block)
+		fmt.Printf("Valid: %s\n", strconv.FormatBool(err == nil))
+		for _, tx := range block.Transactions {
+			fmt.Println(tx)
+		}
+		fmt.Println()
+
+		if !iter.HasNext() {
+			break
+		}
+	}
+}
+
+func (cli *CommandLine) CreateBlockChain(address, nodeID string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("Address is not valid")
+	}
+
+	cli.ConfigureConsensus(nodeID, address)
+	chain := blockchain.InitBlockChain(address, nodeID)
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	fmt.Println("Finished!")
+}
+
+func (cli *CommandLine) GetBalance(address, nodeID string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("Address is not valid")
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	script, err := blockchain.LockingScript(address)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	balance := 0
+	UTXOs := UTXOSet.FindUnspentOutputs(script)
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+
+	fmt.Printf("Balance of %s: %d\n", address, balance)
+}
+
+// Send from is the user mining the transaction
+func (cli *CommandLine) Send(from, to string, amount, fee int, lockTime int64, data, coinSelect, nodeID string, mineNow bool) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("Address is not valid")
+	}
+	if !wallet.ValidateAddress(to) {
+		log.Panic("Address is not valid")
+	}
+	selector, ok := blockchain.CoinSelectors[coinSelect]
+	if !ok {
+		log.Panicf("Unknown coin selection %s", coinSelect)
+	}
+
+	if mineNow {
+		cli.ConfigureConsensus(nodeID, from)
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet := wallets.GetWallet(from)
+
+	outputs := []blockchain.TxOutput{*blockchain.NewTXOutput(amount, to)}
+	if data != "" {
+		payload, err := hex.DecodeString(data)
+		if err != nil {
+			log.Panic(err)
+		}
+		out, err := blockchain.NewDataOutput(payload)
+		if err != nil {
+			log.Panic(err)
+		}
+		outputs = append(outputs, *out)
+	}
+
+	tx := blockchain.NewTransactionOutputs(&wallet, outputs, fee, lockTime, selector, &UTXOSet)
+	submitTx(chain, tx, from, mineNow)
+
+	fmt.Println("Success!")
+}
+
+// AccountSend spends the outputs of every address of the wallet file, the
+// change is sent to a new address added to the wallet file
+func (cli *CommandLine) AccountSend(to string, amount, fee int, coinSelect, miner, nodeID string, mineNow bool) {
+	if !wallet.ValidateAddress(to) {
+		log.Panic("Address is not valid")
+	}
+	if mineNow && !wallet.ValidateAddress(miner) {
+		log.Panic("Miner address is not valid")
+	}
+	selector, ok := blockchain.CoinSelectors[coinSelect]
+	if !ok {
+		log.Panicf("Unknown coin selection %s", coinSelect)
+	}
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	var accounts []*wallet.Wallet
+	for _, w := range wallets.Wallets {
+		accounts = append(accounts, w)
+	}
+	// the change address is only saved if the transaction pays change
+	changeWallet := wallet.MakeWallet()
+	change := string(changeWallet.Address())
+
+	if mineNow {
+		cli.ConfigureConsensus(nodeID, miner)
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(chain)
+
+	outputs := []blockchain.TxOutput{*blockchain.NewTXOutput(amount, to)}
+	tx := blockchain.NewAccountTransaction(accounts, outputs, fee, 0, selector, change, &UTXOSet)
+
+	changeScript := blockchain.P2PKHScript(wallet.PublicKeyHash(changeWallet.PublicKey))
+	paysChange := false
+	for _, out := range tx.Outputs {
+		paysChange = paysChange || bytes.Equal(out.ScriptPubKey, changeScript)
+	}
+	if paysChange {
+		wallets.Wallets[change] = changeWallet
+		wallets.SaveFile(nodeID)
+	}
+
+	submitTx(chain, tx, miner, mineNow)
+
+	if paysChange {
+		fmt.Printf("Sent %d from %d inputs in transaction %x, change address %s\n", amount, len(tx.Inputs), tx.ID, change)
+	} else {
+		fmt.Printf("Sent %d from %d inputs in transaction %x without change\n", amount, len(tx.Inputs), tx.ID)
+	}
+}
+
+// payment is an amount sent to an address by sendmany
+type payment struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+// SendMany pays every recipient in a single transaction with one change output
+func (cli *CommandLine) SendMany(from string, payments []payment, fee int, coinSelect, nodeID string, mineNow bool) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("Address is not valid")
+	}
+	selector, ok := blockchain.CoinSelectors[coinSelect]
+	if !ok {
+		log.Panicf("Unknown coin selection %s", coinSelect)
+	}
+
+	var outputs []blockchain.TxOutput
+	total := 0
+	for _, p := range payments {
+		if !wallet.ValidateAddress(p.Address) {
+			log.Panicf("Address %s is not valid", p.Address)
+		}
+		if p.Amount <= 0 {
+			log.Panicf("The amount sent to %s must be positive", p.Address)
+		}
+		outputs = append(outputs, *blockchain.NewTXOutput(p.Amount, p.Address))
+		total += p.Amount
+	}
+
+	if mineNow {
+		cli.ConfigureConsensus(nodeID, from)
+	}
 	chain := blockchain.ContinueBlockChain(nodeID)
-	defer func(Database *badger.DB) {
-		err := Database.Close()
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
 		if err != nil {
 			log.Panic(err)
 		}
-	}(chain.Database)
+	}(chain)
 
-	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
-	UTXOSet.Reindex()
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w := wallets.GetWallet(from)
 
-	count := UTXOSet.CountTransactions()
-	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+	tx := blockchain.NewTransactionOutputs(&w, outputs, fee, 0, selector, &UTXOSet)
+	submitTx(chain, tx, from, mineNow)
+
+	fmt.Printf("Sent %d to %d addresses in transaction %x\n", total, len(payments), tx.ID)
 }
 
-func (cli *CommandLine) PrintChain(nodeID string) {
-	chain := blockchain.ContinueBlockChain(nodeID)
-	defer func(Database *badger.DB) {
-		err := Database.Close()
+// parsePayments reads the ADDRESS:AMOUNT pairs of list, or the payments of a
+// JSON array of {"address", "amount"} objects or of a CSV file of
+// address,amount records
+func parsePayments(list, file string) []payment {
+	var payments []payment
+
+	parse := func(address, amount string) {
+		value, err := strconv.Atoi(strings.TrimSpace(amount))
 		if err != nil {
-			log.Panic(err)
+			log.Panicf("Invalid amount %q for %s", amount, address)
 		}
-	}(chain.Database)
-
-	iter := chain.Iterator()
-	for {
-		block := iter.Next()
+		payments = append(payments, payment{strings.TrimSpace(address), value})
+	}
 
-		fmt.Printf("Previous Hash: %x\n", block.PrevHash)
-		fmt.Printf("Hash: %x\n", block.Hash)
+	if list != "" {
+		for _, pair := range strings.Split(list, ",") {
+			parts := strings.Split(pair, ":")
+			if len(parts) != 2 {
+				log.Panicf("Invalid payment %q, expected ADDRESS:AMOUNT", pair)
+			}
+			parse(parts[0], parts[1])
+		}
+	}
 
-		pow := blockchain.NewProof(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Panic(err)
 		}
-		fmt.Println()
 
-		if len(block.PrevHash) == 0 {
-			break
+		if strings.HasSuffix(strings.ToLower(file), ".json") {
+			var filePayments []payment
+			if err := json.Unmarshal(content, &filePayments); err != nil {
+				log.Panic(err)
+			}
+			payments = append(payments, filePayments...)
+		} else {
+			records, err := csv.NewReader(strings.NewReader(string(content))).ReadAll()
+			if err != nil {
+				log.Panic(err)
+			}
+			for i, record := range records {
+				if len(record) != 2 {
+					log.Panicf("Invalid record %v, expected address,amount", record)
+				}
+				// header
+				if i == 0 && strings.TrimSpace(record[1]) == "amount" {
+					continue
+				}
+				parse(record[0], record[1])
+			}
 		}
 	}
+
+	return payments
 }
 
-func (cli *CommandLine) CreateBlockChain(address, nodeID string) {
-	if !wallet.ValidateAddress(address) {
+// Anchor records the SHA256 hash of a file in a data output
+func (cli *CommandLine) Anchor(from, file, nodeID string, mineNow bool) {
+	if !wallet.ValidateAddress(from) {
 		log.Panic("Address is not valid")
 	}
 
-	chain := blockchain.InitBlockChain(address, nodeID)
-	defer func(Database *badger.DB) {
-		err := Database.Close()
+	hash := fileHash(file)
+	out, err := blockchain.NewDataOutput(hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if mineNow {
+		cli.ConfigureConsensus(nodeID, from)
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
 		if err != nil {
 			log.Panic(err)
 		}
-	}(chain.Database)
+	}(chain)
 
-	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
-	UTXOSet.Reindex()
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w := wallets.GetWallet(from)
 
-	fmt.Println("Finished!")
+	tx := blockchain.NewTransactionOutputs(&w, []blockchain.TxOutput{*out}, 0, 0, blockchain.DefaultCoinSelector, &UTXOSet)
+	submitTx(chain, tx, from, mineNow)
+
+	fmt.Printf("Anchored %x in transaction %x\n", hash, tx.ID)
 }
 
-func (cli *CommandLine) GetBalance(address, nodeID string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address is not valid")
+// FindAnchor prints the block containing the anchored data, given in hex or
+// as the SHA256 hash of a file
+func (cli *CommandLine) FindAnchor(data, file, nodeID string) {
+	var anchored []byte
+	if file != "" {
+		anchored = fileHash(file)
+	} else {
+		var err error
+		if anchored, err = hex.DecodeString(data); err != nil {
+			log.Panic(err)
+		}
 	}
 
 	chain := blockchain.ContinueBlockChain(nodeID)
-	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
-	defer func(Database *badger.DB) {
-		err := Database.Close()
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
 		if err != nil {
 			log.Panic(err)
 		}
-	}(chain.Database)
+	}(chain)
 
-	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
-	for _, out := range UTXOs {
-		balance += out.Value
+	block, tx, err := chain.FindAnchor(anchored)
+	if err != nil {
+		log.Panic(err)
 	}
 
-	fmt.Printf("Balance of %s: %d\n", address, balance)
+	fmt.Printf("Block %x, height %d, time %s\n", block.Hash, block.Height, time.Unix(block.Timestamp, 0))
+	fmt.Printf("Transaction %x\n", tx.ID)
 }
 
-// Send from is the user mining the transaction
-func (cli *CommandLine) Send(from, to string, amount int, nodeID string, mineNow bool) {
-	if !wallet.ValidateAddress(from) {
-		log.Panic("Address is not valid")
+func fileHash(file string) []byte {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
 	}
-	if !wallet.ValidateAddress(to) {
-		log.Panic("Address is not valid")
+	hash := sha256.Sum256(content)
+
+	return hash[:]
+}
+
+// submitTx mines tx in a block rewarding miner or sends it to the central
+// node, the sent transactions are kept to bump their fee
+func submitTx(chain *blockchain.BlockChain, tx *blockchain.Transaction, miner string, mineNow bool) {
+	if mineNow {
+		fee, err := chain.TransactionFee(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		cbTx := blockchain.CoinbaseTxWithFees(miner, "", fee)
+		txs := []*blockchain.Transaction{cbTx, tx}
+		if _, err := chain.MineBlock(txs); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		chain.SaveWalletTx(tx)
+		network.SendTx(network.KnownNodes[0], tx)
+		fmt.Println("Send tx")
+	}
+}
+
+// BumpFee replaces an unconfirmed transaction sent by our wallets with one
+// paying fee, or 1 more than its fee per 1000 bytes if fee is 0
+func (cli *CommandLine) BumpFee(txID string, fee int, nodeID string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
 	}
 
 	chain := blockchain.ContinueBlockChain(nodeID)
 	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
-	defer func(Database *badger.DB) {
-		err := Database.Close()
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
 		if err != nil {
 			log.Panic(err)
 		}
-	}(chain.Database)
+	}(chain)
+
+	if _, err := chain.FindTransaction(id); err == nil {
+		log.Panic("The transaction is already confirmed")
+	}
+	tx, err := chain.WalletTx(id)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	wallets, err := wallet.CreateWallets(nodeID)
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
+	var w *wallet.Wallet
+	for _, candidate := range wallets.Wallets {
+		if tx.Inputs[0].UsesKey(wallet.PublicKeyHash(candidate.PublicKey)) {
+			w = candidate
+		}
+	}
+	if w == nil {
+		log.Panic("The transaction was not sent by a wallet of our wallet file")
+	}
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
-	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from, "")
-		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
-	} else {
-		network.SendTx(network.KnownNodes[0], tx)
-		fmt.Println("Send tx")
+	if fee == 0 {
+		oldFee, err := chain.TransactionFee(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		fee = oldFee + (tx.Size()+999)/1000
 	}
 
-	fmt.Println("Success!")
+	newTx, err := blockchain.BumpFee(w, tx, fee, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	chain.SaveWalletTx(newTx)
+	chain.DeleteWalletTx(tx.ID)
+	network.SendTx(network.KnownNodes[0], newTx)
+
+	fmt.Printf("Transaction %x replaced by %x with a fee of %d\n", tx.ID, newTx.ID, fee)
 }
 
 func (cli *CommandLine) Run() {
@@ -201,23 +1212,125 @@ func (cli *CommandLine) Run() {
 		fmt.Println("NODE_ID env is not set!")
 		runtime.Goexit()
 	}
+	cli.ConfigureCheckpoints()
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	sendManyCmd := flag.NewFlagSet("sendmany", flag.ExitOnError)
+	accountSendCmd := flag.NewFlagSet("accountsend", flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	anchorCmd := flag.NewFlagSet("anchor", flag.ExitOnError)
+	findAnchorCmd := flag.NewFlagSet("findanchor", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("print", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	createMultisigTxCmd := flag.NewFlagSet("createmultisigtx", flag.ExitOnError)
+	signMultisigTxCmd := flag.NewFlagSet("signmultisigtx", flag.ExitOnError)
+	sendMultisigTxCmd := flag.NewFlagSet("sendmultisigtx", flag.ExitOnError)
+	createPSBTCmd := flag.NewFlagSet("createpsbt", flag.ExitOnError)
+	signPSBTCmd := flag.NewFlagSet("signpsbt", flag.ExitOnError)
+	finalizePSBTCmd := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+	broadcastCmd := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	createHTLCCmd := flag.NewFlagSet("createhtlc", flag.ExitOnError)
+	claimHTLCCmd := flag.NewFlagSet("claimhtlc", flag.ExitOnError)
+	refundHTLCCmd := flag.NewFlagSet("refundhtlc", flag.ExitOnError)
+	getHTLCSecretCmd := flag.NewFlagSet("gethtlcsecret", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	getTxOutSetInfoCmd := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
+	verifyUTXOCmd := flag.NewFlagSet("verifyutxo", flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	minerCmd := flag.NewFlagSet("miner", flag.ExitOnError)
+	miningInfoCmd := flag.NewFlagSet("mininginfo", flag.ExitOnError)
+	estimateFeeCmd := flag.NewFlagSet("estimatefee", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The name of the account")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "The address of the wallet")
+	createMultisigRequired := createMultisigCmd.Int("required", 1, "Number of signatures needed to spend")
+	createMultisigPubKeys := createMultisigCmd.String("pubkeys", "", "Comma separated hex public keys of the members")
+	createMultisigTxFrom := createMultisigTxCmd.String("from", "", "Source multisig address")
+	createMultisigTxTo := createMultisigTxCmd.String("to", "", "Destination wallet address")
+	createMultisigTxAmount := createMultisigTxCmd.Int("amount", 0, "Amount to send")
+	createMultisigTxRedeemScript := createMultisigTxCmd.String("redeemscript", "", "Hex redeem script of a pay to script hash address")
+	createMultisigTxFile := createMultisigTxCmd.String("file", "", "Transaction file to write")
+	signMultisigTxAddress := signMultisigTxCmd.String("address", "", "Member address of our wallet file")
+	signMultisigTxFile := signMultisigTxCmd.String("file", "", "Transaction file to sign")
+	sendMultisigTxFile := sendMultisigTxCmd.String("file", "", "Signed transaction file")
+	createPSBTFrom := createPSBTCmd.String("from", "", "Source address")
+	createPSBTTo := createPSBTCmd.String("to", "", "Destination wallet address")
+	createPSBTAmount := createPSBTCmd.Int("amount", 0, "Amount to send")
+	createPSBTFee := createPSBTCmd.Int("fee", 0, "Fee paid to the miner")
+	createPSBTCoinSelect := createPSBTCmd.String("coinselect", "bnb", "Coin selection: bnb, largest, smallest or random")
+	createPSBTRedeemScript := createPSBTCmd.String("redeemscript", "", "Hex redeem script of a pay to script hash address")
+	createPSBTFile := createPSBTCmd.String("file", "", "Partially signed transaction file to write")
+	signPSBTAddress := signPSBTCmd.String("address", "", "Address of our wallet file")
+	signPSBTSigHash := signPSBTCmd.String("sighash", "ALL", "Signature hash type: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	signPSBTFile := signPSBTCmd.String("file", "", "Partially signed transaction file")
+	finalizePSBTFile := finalizePSBTCmd.String("file", "", "Partially signed transaction file")
+	finalizePSBTOut := finalizePSBTCmd.String("out", "", "Transaction file to write")
+	broadcastFile := broadcastCmd.String("file", "", "Finalized transaction file")
+	createHTLCFrom := createHTLCCmd.String("from", "", "Wallet address funding the contract and refunded after the lock time")
+	createHTLCTo := createHTLCCmd.String("to", "", "Address claiming the contract with the secret")
+	createHTLCAmount := createHTLCCmd.Int("amount", 0, "Amount to lock")
+	createHTLCHash := createHTLCCmd.String("hash", "", "Hex SHA256 of the secret of the other side of a swap")
+	createHTLCLockTime := createHTLCCmd.Int64("locktime", 0, "Block height or unix time of the refund")
+	createHTLCMine := createHTLCCmd.Bool("mine", false, "Mine immediately on the same node")
+	claimHTLCAddress := claimHTLCCmd.String("address", "", "Recipient address of our wallet file")
+	claimHTLCRedeemScript := claimHTLCCmd.String("redeemscript", "", "Hex redeem script of the contract")
+	claimHTLCSecret := claimHTLCCmd.String("secret", "", "Hex secret of the contract")
+	claimHTLCMine := claimHTLCCmd.Bool("mine", false, "Mine immediately on the same node")
+	refundHTLCAddress := refundHTLCCmd.String("address", "", "Sender address of our wallet file")
+	refundHTLCRedeemScript := refundHTLCCmd.String("redeemscript", "", "Hex redeem script of the contract")
+	refundHTLCMine := refundHTLCCmd.Bool("mine", false, "Mine immediately on the same node")
+	getHTLCSecretRedeemScript := getHTLCSecretCmd.String("redeemscript", "", "Hex redeem script of the contract")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The name of the account")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Block height or unix time before which the transaction cannot be mined")
+	sendData := sendCmd.String("data", "", "Hex data carried by the transaction")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendCoinSelect := sendCmd.String("coinselect", "bnb", "Coin selection: bnb, largest, smallest or random")
+	sendManyFrom := sendManyCmd.String("from", "", "Source wallet address")
+	sendManyTo := sendManyCmd.String("to", "", "Comma separated ADDRESS:AMOUNT payments")
+	sendManyFile := sendManyCmd.String("file", "", "JSON or CSV file of the payments")
+	sendManyFee := sendManyCmd.Int("fee", 0, "Fee paid to the miner")
+	sendManyCoinSelect := sendManyCmd.String("coinselect", "bnb", "Coin selection: bnb, largest, smallest or random")
+	sendManyMine := sendManyCmd.Bool("mine", false, "Mine immediately on the same node")
+	accountSendTo := accountSendCmd.String("to", "", "Destination wallet address")
+	accountSendAmount := accountSendCmd.Int("amount", 0, "Amount to send")
+	accountSendFee := accountSendCmd.Int("fee", 0, "Fee paid to the miner")
+	accountSendCoinSelect := accountSendCmd.String("coinselect", "bnb", "Coin selection: bnb, largest, smallest or random")
+	accountSendMine := accountSendCmd.Bool("mine", false, "Mine immediately on the same node")
+	accountSendMiner := accountSendCmd.String("miner", "", "Address rewarded and sealing the block with -mine")
+	sendDust := sendCmd.Int("dust", blockchain.DustThreshold, "Smallest change output")
+	sendManyDust := sendManyCmd.Int("dust", blockchain.DustThreshold, "Smallest change output")
+	accountSendDust := accountSendCmd.Int("dust", blockchain.DustThreshold, "Smallest change output")
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "Unconfirmed transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "New fee, by default 1 more per 1000 bytes")
+	anchorFrom := anchorCmd.String("from", "", "Source wallet address")
+	anchorFile := anchorCmd.String("file", "", "File whose hash is anchored")
+	anchorMine := anchorCmd.Bool("mine", false, "Mine immediately on the same node")
+	findAnchorData := findAnchorCmd.String("data", "", "Hex anchored data")
+	findAnchorFile := findAnchorCmd.String("file", "", "File whose hash was anchored")
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "Snapshot file to write")
+	loadUTXOFile := loadUTXOCmd.String("file", "", "Snapshot file to read")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward")
+	startNodeWork := startNodeCmd.String("work", "", "Address of the work server for external miners")
+	startNodePrune := startNodeCmd.Int("prune", 0, "Delete the block bodies deeper than this depth")
+	startNodeUTXOCache := startNodeCmd.Int("utxocache", blockchain.UTXOCacheSize>>20, "Memory budget of the UTXO cache in MB")
+	startNodeMinFeeRate := startNodeCmd.Int("minfeerate", network.MinBlockFeeRate, "Lowest fee per 1000 bytes of the mined transactions")
+	minerWork := minerCmd.String("work", "", "Address of the node work server")
+	minerThreads := minerCmd.Int("threads", runtime.NumCPU(), "Number of mining threads")
+	miningInfoBlocks := miningInfoCmd.Int("blocks", 10, "Number of blocks used for the estimations")
+	miningInfoWork := miningInfoCmd.String("work", "", "Address of the work server of a running node")
+	estimateFeeBlocks := estimateFeeCmd.Int("blocks", 6, "Number of blocks within which the transaction is confirmed")
+	estimateFeeWork := estimateFeeCmd.String("work", "", "Address of the work server of a running node")
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -228,6 +1341,58 @@ func (cli *CommandLine) Run() {
 		if err := listAddressesCmd.Parse(os.Args[2:]); err != nil {
 			log.Panic(err)
 		}
+	case "getpubkey":
+		if err := getPubKeyCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		if err := createMultisigCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "createmultisigtx":
+		if err := createMultisigTxCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "signmultisigtx":
+		if err := signMultisigTxCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "sendmultisigtx":
+		if err := sendMultisigTxCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "createpsbt":
+		if err := createPSBTCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "signpsbt":
+		if err := signPSBTCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "finalizepsbt":
+		if err := finalizePSBTCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "broadcast":
+		if err := broadcastCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "createhtlc":
+		if err := createHTLCCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "claimhtlc":
+		if err := claimHTLCCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "refundhtlc":
+		if err := refundHTLCCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "gethtlcsecret":
+		if err := getHTLCSecretCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
 	case "createwallet":
 		if err := createWalletCmd.Parse(os.Args[2:]); err != nil {
 			log.Panic(err)
@@ -236,6 +1401,22 @@ func (cli *CommandLine) Run() {
 		if err := reindexUTXOCmd.Parse(os.Args[2:]); err != nil {
 			log.Panic(err)
 		}
+	case "gettxoutsetinfo":
+		if err := getTxOutSetInfoCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "verifyutxo":
+		if err := verifyUTXOCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "dumputxo":
+		if err := dumpUTXOCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "loadutxo":
+		if err := loadUTXOCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain":
 		if err := createBlockchainCmd.Parse(os.Args[2:]); err != nil {
 			log.Panic(err)
@@ -248,10 +1429,42 @@ func (cli *CommandLine) Run() {
 		if err := sendCmd.Parse(os.Args[2:]); err != nil {
 			log.Panic(err)
 		}
+	case "sendmany":
+		if err := sendManyCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "accountsend":
+		if err := accountSendCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "bumpfee":
+		if err := bumpFeeCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "anchor":
+		if err := anchorCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "findanchor":
+		if err := findAnchorCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
 	case "startnode":
 		if err := startNodeCmd.Parse(os.Args[2:]); err != nil {
 			log.Panic(err)
 		}
+	case "miner":
+		if err := minerCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "mininginfo":
+		if err := miningInfoCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "estimatefee":
+		if err := estimateFeeCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.PrintUsage()
 		runtime.Goexit()
@@ -282,23 +1495,208 @@ func (cli *CommandLine) Run() {
 	if reindexUTXOCmd.Parsed() {
 		cli.ReindexUTXO(nodeID)
 	}
+	if getTxOutSetInfoCmd.Parsed() {
+		cli.GetTxOutSetInfo(nodeID)
+	}
+	if verifyUTXOCmd.Parsed() {
+		cli.VerifyUTXO(nodeID)
+	}
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOFile == "" {
+			dumpUTXOCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.DumpUTXO(nodeID, *dumpUTXOFile)
+	}
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOFile == "" {
+			loadUTXOCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.LoadUTXO(nodeID, *loadUTXOFile)
+	}
 	if listAddressesCmd.Parsed() {
 		cli.ListAddresses(nodeID)
 	}
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.GetPubKey(*getPubKeyAddress, nodeID)
+	}
+	if createMultisigCmd.Parsed() {
+		if *createMultisigPubKeys == "" {
+			createMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.CreateMultisig(*createMultisigRequired, *createMultisigPubKeys)
+	}
+	if createMultisigTxCmd.Parsed() {
+		if *createMultisigTxFrom == "" || *createMultisigTxTo == "" || *createMultisigTxAmount <= 0 || *createMultisigTxFile == "" {
+			createMultisigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.CreateMultisigTx(*createMultisigTxFrom, *createMultisigTxTo, *createMultisigTxAmount, *createMultisigTxRedeemScript, *createMultisigTxFile, nodeID)
+	}
+	if signMultisigTxCmd.Parsed() {
+		if *signMultisigTxAddress == "" || *signMultisigTxFile == "" {
+			signMultisigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.SignMultisigTx(*signMultisigTxAddress, *signMultisigTxFile, nodeID)
+	}
+	if sendMultisigTxCmd.Parsed() {
+		if *sendMultisigTxFile == "" {
+			sendMultisigTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.SendMultisigTx(*sendMultisigTxFile)
+	}
+
+	if createPSBTCmd.Parsed() {
+		if *createPSBTFrom == "" || *createPSBTTo == "" || *createPSBTAmount <= 0 || *createPSBTFile == "" {
+			createPSBTCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.CreatePSBT(*createPSBTFrom, *createPSBTTo, *createPSBTAmount, *createPSBTFee, *createPSBTCoinSelect, *createPSBTRedeemScript, *createPSBTFile, nodeID)
+	}
+
+	if signPSBTCmd.Parsed() {
+		if *signPSBTAddress == "" || *signPSBTFile == "" {
+			signPSBTCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.SignPSBT(*signPSBTAddress, *signPSBTSigHash, *signPSBTFile, nodeID)
+	}
+
+	if finalizePSBTCmd.Parsed() {
+		if *finalizePSBTFile == "" || *finalizePSBTOut == "" {
+			finalizePSBTCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.FinalizePSBT(*finalizePSBTFile, *finalizePSBTOut)
+	}
+
+	if broadcastCmd.Parsed() {
+		if *broadcastFile == "" {
+			broadcastCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.Broadcast(*broadcastFile)
+	}
+	if createHTLCCmd.Parsed() {
+		if *createHTLCFrom == "" || *createHTLCTo == "" || *createHTLCAmount <= 0 || *createHTLCLockTime <= 0 {
+			createHTLCCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.CreateHTLC(*createHTLCFrom, *createHTLCTo, *createHTLCAmount, *createHTLCHash, *createHTLCLockTime, nodeID, *createHTLCMine)
+	}
+	if claimHTLCCmd.Parsed() {
+		if *claimHTLCAddress == "" || *claimHTLCRedeemScript == "" || *claimHTLCSecret == "" {
+			claimHTLCCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.ClaimHTLC(*claimHTLCAddress, *claimHTLCRedeemScript, *claimHTLCSecret, nodeID, *claimHTLCMine)
+	}
+	if refundHTLCCmd.Parsed() {
+		if *refundHTLCAddress == "" || *refundHTLCRedeemScript == "" {
+			refundHTLCCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.RefundHTLC(*refundHTLCAddress, *refundHTLCRedeemScript, nodeID, *refundHTLCMine)
+	}
+	if getHTLCSecretCmd.Parsed() {
+		if *getHTLCSecretRedeemScript == "" {
+			getHTLCSecretCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.GetHTLCSecret(*getHTLCSecretRedeemScript, nodeID)
+	}
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
 		if nodeID == "" {
 			startNodeCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+		blockchain.UTXOCacheSize = *startNodeUTXOCache << 20
+		network.MinBlockFeeRate = *startNodeMinFeeRate
+		cli.StartNode(nodeID, *startNodeMiner, *startNodeWork, *startNodePrune)
+	}
+
+	if minerCmd.Parsed() {
+		if *minerWork == "" {
+			minerCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.Miner(*minerWork, *minerThreads)
+	}
+
+	if miningInfoCmd.Parsed() {
+		if *miningInfoBlocks <= 0 {
+			miningInfoCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.MiningInfo(nodeID, *miningInfoBlocks, *miningInfoWork)
+	}
+
+	if estimateFeeCmd.Parsed() {
+		if *estimateFeeBlocks <= 0 {
+			estimateFeeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.EstimateFee(nodeID, *estimateFeeBlocks, *estimateFeeWork)
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendDust < 1 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.Send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		blockchain.DustThreshold = *sendDust
+		cli.Send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendLockTime, *sendData, *sendCoinSelect, nodeID, *sendMine)
+	}
+
+	if sendManyCmd.Parsed() {
+		if *sendManyFrom == "" || (*sendManyTo == "" && *sendManyFile == "") || *sendManyDust < 1 {
+			sendManyCmd.Usage()
+			runtime.Goexit()
+		}
+		blockchain.DustThreshold = *sendManyDust
+		payments := parsePayments(*sendManyTo, *sendManyFile)
+		cli.SendMany(*sendManyFrom, payments, *sendManyFee, *sendManyCoinSelect, nodeID, *sendManyMine)
+	}
+
+	if accountSendCmd.Parsed() {
+		if *accountSendTo == "" || *accountSendAmount <= 0 || (*accountSendMine && *accountSendMiner == "") || *accountSendDust < 1 {
+			accountSendCmd.Usage()
+			runtime.Goexit()
+		}
+		blockchain.DustThreshold = *accountSendDust
+		cli.AccountSend(*accountSendTo, *accountSendAmount, *accountSendFee, *accountSendCoinSelect, *accountSendMiner, nodeID, *accountSendMine)
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" || *bumpFeeFee < 0 {
+			bumpFeeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.BumpFee(*bumpFeeTxID, *bumpFeeFee, nodeID)
+	}
+
+	if anchorCmd.Parsed() {
+		if *anchorFrom == "" || *anchorFile == "" {
+			anchorCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.Anchor(*anchorFrom, *anchorFile, nodeID, *anchorMine)
+	}
+
+	if findAnchorCmd.Parsed() {
+		if *findAnchorData == "" && *findAnchorFile == "" {
+			findAnchorCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.FindAnchor(*findAnchorData, *findAnchorFile, nodeID)
 	}
 }
@@ -0,0 +1,434 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nclv/golang-blockchain/blockchain"
+)
+
+const (
+	// MaxReplacements bounds the transactions evicted by a replacement
+	MaxReplacements = 100
+	// MaxAncestors bounds the unconfirmed transactions a transaction of the
+	// pool depends on, itself included
+	MaxAncestors = 25
+)
+
+var (
+	// MaxBlockTxSize bounds the size of the transactions of a block template
+	MaxBlockTxSize = 1 << 20
+	// MinBlockFeeRate is the lowest fee per 1000 bytes of the packages of
+	// transactions included in a block template
+	MinBlockFeeRate = 0
+)
+
+// MempoolEntry is an unconfirmed transaction with its fee and the height of
+// the chain when it entered the pool
+type MempoolEntry struct {
+	Tx     *blockchain.Transaction
+	Fee    int
+	Size   int
+	Height int
+}
+
+func (e *MempoolEntry) FeeRate() int {
+	return blockchain.FeeRate(e.Fee, e.Size)
+}
+
+// Mempool holds the unconfirmed transactions by hex ID. A transaction can spend
+// the outputs of the transactions of the pool, its ancestors, and is mined with
+// them. A transaction spending the same output as transactions of the pool
+// replaces them if it pays a higher fee and fee rate. The blocks waited by
+// the transactions before their confirmation give the fee estimates.
+type Mempool struct {
+	mutex   sync.Mutex
+	entries map[string]*MempoolEntry
+	// the transaction of the pool spending each output
+	spentBy  map[blockchain.Outpoint]string
+	feeStats *blockchain.FeeStats
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		entries:  make(map[string]*MempoolEntry),
+		spentBy:  make(map[blockchain.Outpoint]string),
+		feeStats: blockchain.NewFeeStats(),
+	}
+}
+
+func (m *Mempool) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.entries)
+}
+
+func (m *Mempool) Get(txID []byte) (*blockchain.Transaction, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.entries[hex.EncodeToString(txID)]
+	if !ok {
+		return nil, false
+	}
+
+	return entry.Tx, true
+}
+
+// Entries returns the transactions of the pool
+func (m *Mempool) Entries() []*MempoolEntry {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var entries []*MempoolEntry
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Add accepts tx if it can be mined in the next block, the transactions it
+// conflicts with and their descendants are replaced
+func (m *Mempool) Add(tx *blockchain.Transaction, chain *blockchain.BlockChain) error {
+	if tx.IsCoinbase() {
+		return errors.New("a coinbase transaction cannot be relayed")
+	}
+	if err := tx.CheckSanity(); err != nil {
+		return err
+	}
+	if err := chain.CheckLocks(tx, chain.GetBestHeight()+1, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := m.entries[id]; ok {
+		return fmt.Errorf("transaction %x is already in the memory pool", tx.ID)
+	}
+
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	prevOuts := make(map[blockchain.Outpoint]blockchain.TxOutput)
+	parents := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		if parent, ok := m.entries[hex.EncodeToString(in.ID)]; ok {
+			if in.Out < 0 || in.Out >= len(parent.Tx.Outputs) {
+				return fmt.Errorf("output %d of transaction %x does not exist", in.Out, in.ID)
+			}
+			prevOuts[in.Outpoint()] = parent.Tx.Outputs[in.Out]
+			parents[hex.EncodeToString(in.ID)] = true
+			continue
+		}
+
+		entry, err := UTXOSet.GetEntry(in.Outpoint())
+		if err != nil {
+			return err
+		}
+		prevOuts[in.Outpoint()] = entry.Output
+	}
+	if !tx.Verify(prevOuts) {
+		return fmt.Errorf("invalid signature in transaction %x", tx.ID)
+	}
+	fee, err := tx.Fee(prevOuts)
+	if err != nil {
+		return err
+	}
+	entry := &MempoolEntry{tx, fee, tx.Size(), chain.GetBestHeight()}
+
+	ancestors := m.ancestors(parents)
+	if len(ancestors)+1 > MaxAncestors {
+		return fmt.Errorf("the transaction has more than %d unconfirmed ancestors", MaxAncestors-1)
+	}
+
+	conflicts := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		if spender, ok := m.spentBy[in.Outpoint()]; ok {
+			conflicts[spender] = true
+		}
+	}
+
+	if len(conflicts) > 0 {
+		// the replaced fee rates are compared with the direct conflicts only,
+		// the descendants are evicted with them
+		for conflict := range conflicts {
+			if entry.Fee*m.entries[conflict].Size <= m.entries[conflict].Fee*entry.Size {
+				return fmt.Errorf("the fee rate is not higher than the one of the conflicting transaction %s", conflict)
+			}
+		}
+
+		replaced := m.descendants(conflicts)
+		for replacedID := range replaced {
+			if ancestors[replacedID] {
+				return fmt.Errorf("the transaction spends the outputs of the transaction %s it replaces", replacedID)
+			}
+		}
+		if len(replaced) > MaxReplacements {
+			return fmt.Errorf("the transaction would replace more than %d transactions", MaxReplacements)
+		}
+		replacedFees := 0
+		for replacedID := range replaced {
+			replacedFees += m.entries[replacedID].Fee
+		}
+		if entry.Fee <= replacedFees {
+			return fmt.Errorf("the fee %d is not higher than the %d paid by the replaced transactions", entry.Fee, replacedFees)
+		}
+
+		for replacedID := range replaced {
+			fmt.Printf("Transaction %s replaced by %x\n", replacedID, tx.ID)
+			m.remove(replacedID)
+		}
+	}
+
+	m.entries[id] = entry
+	for _, in := range tx.Inputs {
+		m.spentBy[in.Outpoint()] = id
+	}
+
+	return nil
+}
+
+// ancestors returns the transactions with the transactions of the pool whose
+// outputs they spend, recursively
+func (m *Mempool) ancestors(ids map[string]bool) map[string]bool {
+	found := make(map[string]bool)
+
+	var visit func(id string)
+	visit = func(id string) {
+		if found[id] {
+			return
+		}
+		found[id] = true
+
+		for _, in := range m.entries[id].Tx.Inputs {
+			if parent := hex.EncodeToString(in.ID); m.entries[parent] != nil {
+				visit(parent)
+			}
+		}
+	}
+	for id := range ids {
+		visit(id)
+	}
+
+	return found
+}
+
+// PackageFeeRate returns the fee rate of a transaction of the pool with its
+// unconfirmed ancestors, which are mined with it, and the one of the
+// transaction with its descendants
+func (m *Mempool) PackageFeeRate(txID []byte) (int, int, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id := hex.EncodeToString(txID)
+	if _, ok := m.entries[id]; !ok {
+		return 0, 0, false
+	}
+
+	feeRate := func(ids map[string]bool) int {
+		fee, size := 0, 0
+		for id := range ids {
+			fee += m.entries[id].Fee
+			size += m.entries[id].Size
+		}
+		return blockchain.FeeRate(fee, size)
+	}
+	tx := map[string]bool{id: true}
+
+	return feeRate(m.ancestors(tx)), feeRate(m.descendants(tx)), true
+}
+
+// descendants returns the transactions with the transactions of the pool
+// spending their outputs, recursively
+func (m *Mempool) descendants(ids map[string]bool) map[string]bool {
+	found := make(map[string]bool)
+
+	var visit func(id string)
+	visit = func(id string) {
+		if found[id] {
+			return
+		}
+		found[id] = true
+
+		entry := m.entries[id]
+		for outIdx := range entry.Tx.Outputs {
+			if spender, ok := m.spentBy[blockchain.NewOutpoint(entry.Tx.ID, outIdx)]; ok {
+				visit(spender)
+			}
+		}
+	}
+	for id := range ids {
+		visit(id)
+	}
+
+	return found
+}
+
+func (m *Mempool) remove(id string) {
+	entry, ok := m.entries[id]
+	if !ok {
+		return
+	}
+
+	for _, in := range entry.Tx.Inputs {
+		if m.spentBy[in.Outpoint()] == id {
+			delete(m.spentBy, in.Outpoint())
+		}
+	}
+	delete(m.entries, id)
+}
+
+// BlockTxs selects the transactions of a block template by decreasing fee rate
+// of their package with their unconfirmed ancestors, so that a transaction
+// paying a high fee gets its ancestors mined. It returns them parents first,
+// with the sum of their fees. The transactions whose inputs are spent are
+// dropped from the pool.
+func (m *Mempool) BlockTxs(chain *blockchain.BlockChain) ([]*blockchain.Transaction, int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// the pool is only updated with the blocks of the best chain
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	invalid := make(map[string]bool)
+	for id, entry := range m.entries {
+		for _, in := range entry.Tx.Inputs {
+			if m.entries[hex.EncodeToString(in.ID)] != nil {
+				continue
+			}
+			if _, err := UTXOSet.GetEntry(in.Outpoint()); err != nil {
+				invalid[id] = true
+			}
+		}
+	}
+	for id := range m.descendants(invalid) {
+		m.remove(id)
+	}
+
+	height := chain.GetBestHeight() + 1
+	now := time.Now().Unix()
+	locked := make(map[string]bool)
+	for id, entry := range m.entries {
+		if chain.CheckLocks(entry.Tx, height, now) != nil {
+			locked[id] = true
+		}
+	}
+	skipped := m.descendants(locked)
+
+	var txs []*blockchain.Transaction
+	included := make(map[string]bool)
+	fees, size := 0, 0
+	for {
+		var best map[string]bool
+		var leader string
+		bestFee, bestSize := 0, 0
+		for id := range m.entries {
+			if included[id] || skipped[id] {
+				continue
+			}
+
+			pkg := m.ancestors(map[string]bool{id: true})
+			pkgFee, pkgSize := 0, 0
+			for ancestor := range pkg {
+				if included[ancestor] {
+					delete(pkg, ancestor)
+					continue
+				}
+				pkgFee += m.entries[ancestor].Fee
+				pkgSize += m.entries[ancestor].Size
+			}
+			if best == nil || pkgFee*bestSize > bestFee*pkgSize {
+				best, leader, bestFee, bestSize = pkg, id, pkgFee, pkgSize
+			}
+		}
+		if best == nil || blockchain.FeeRate(bestFee, bestSize) < MinBlockFeeRate {
+			break
+		}
+
+		if size+bestSize > MaxBlockTxSize {
+			// the transaction that led the package is left out, its
+			// ancestors can still lead smaller packages
+			skipped[leader] = true
+			continue
+		}
+
+		// an ancestor has fewer ancestors than its descendants
+		var pkg []string
+		for id := range best {
+			pkg = append(pkg, id)
+		}
+		sort.Slice(pkg, func(i, j int) bool {
+			return len(m.ancestors(map[string]bool{pkg[i]: true})) < len(m.ancestors(map[string]bool{pkg[j]: true}))
+		})
+		for _, id := range pkg {
+			included[id] = true
+			txs = append(txs, m.entries[id].Tx)
+		}
+		fees += bestFee
+		size += bestSize
+	}
+
+	return txs, fees
+}
+
+// RemoveBlock drops the transactions mined in block and the ones spending the
+// same outputs, with their descendants. The blocks waited by the mined
+// transactions are recorded in the fee statistics.
+func (m *Mempool) RemoveBlock(block *blockchain.Block) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.feeStats.Decay()
+
+	conflicts := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		id := hex.EncodeToString(tx.ID)
+		if entry, ok := m.entries[id]; ok {
+			m.feeStats.Record(entry.FeeRate(), block.Height-entry.Height)
+		}
+		m.remove(id)
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if spender, ok := m.spentBy[in.Outpoint()]; ok {
+				conflicts[spender] = true
+			}
+		}
+	}
+
+	for id := range m.descendants(conflicts) {
+		m.remove(id)
+	}
+}
+
+// LoadFeeStats restores the fee statistics saved in the chain database
+func (m *Mempool) LoadFeeStats(chain *blockchain.BlockChain) {
+	stats := chain.FeeStats()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.feeStats = stats
+}
+
+func (m *Mempool) SaveFeeStats(chain *blockchain.BlockChain) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	chain.SaveFeeStats(m.feeStats)
+}
+
+// EstimateFee returns the fee rate for a confirmation within blocks blocks
+func (m *Mempool) EstimateFee(blocks int) blockchain.FeeEstimate {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.feeStats.Estimate(blocks)
+}
@@ -0,0 +1,175 @@
+package network
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nclv/golang-blockchain/blockchain"
+)
+
+// a worker asks for a fresh template after this delay so that it does not
+// keep hashing on a stale tip
+const workRefresh = 10 * time.Second
+
+type WorkClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	nextID  int
+}
+
+func DialWork(address string) (*WorkClient, error) {
+	conn, err := net.Dial(protocol, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WorkClient{conn: conn, scanner: bufio.NewScanner(conn)}, nil
+}
+
+func (c *WorkClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *WorkClient) Call(method string, params interface{}, result interface{}) error {
+	c.nextID++
+	request := WorkRequest{ID: c.nextID, Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		request.Params = data
+	}
+
+	if err := json.NewEncoder(c.conn).Encode(request); err != nil {
+		return err
+	}
+
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("work server closed the connection")
+	}
+
+	var response struct {
+		ID     int             `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	if err := json.Unmarshal(c.scanner.Bytes(), &response); err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(response.Result, result)
+}
+
+// StartMiner runs a worker that searches nonces for the templates handed out
+// by the work server at workAddress
+func StartMiner(workAddress string, threads int) {
+	client, err := DialWork(workAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func(client *WorkClient) {
+		err := client.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(client)
+
+	fmt.Printf("Mining on %s with %d threads\n", workAddress, threads)
+
+	for {
+		var template WorkTemplate
+		if err := client.Call("getwork", nil, &template); err != nil {
+			log.Panic(err)
+		}
+
+		nonce, found := SearchNonce(template, threads, workRefresh)
+		if !found {
+			continue
+		}
+
+		var accepted bool
+		submission := WorkSubmission{template.JobID, nonce}
+		if err := client.Call("submitwork", submission, &accepted); err != nil {
+			fmt.Printf("Block %d rejected: %s\n", template.Height, err)
+			continue
+		}
+		fmt.Printf("Block %d accepted with nonce %d\n", template.Height, nonce)
+	}
+}
+
+// SearchNonce splits the nonce space between threads and stops at the first
+// nonce meeting the target or once timeout has elapsed
+func SearchNonce(template WorkTemplate, threads int, timeout time.Duration) (int, bool) {
+	prevHash, err := hex.DecodeString(template.PrevHash)
+	if err != nil {
+		log.Panic(err)
+	}
+	merkleRoot, err := hex.DecodeString(template.MerkleRoot)
+	if err != nil {
+		log.Panic(err)
+	}
+	target, err := parseTarget(template.Target)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if threads < 1 {
+		threads = 1
+	}
+
+	var stop int32
+	var wg sync.WaitGroup
+	found := make(chan int, threads)
+	deadline := time.Now().Add(timeout)
+
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+
+			var intHash big.Int
+			for i, nonce := 0, start; nonce < math.MaxInt64-threads; i, nonce = i+1, nonce+threads {
+				if i%4096 == 0 {
+					if atomic.LoadInt32(&stop) == 1 || time.Now().After(deadline) {
+						return
+					}
+				}
+
+				hash := sha256.Sum256(blockchain.PowData(prevHash, merkleRoot, template.Height, template.Timestamp, nonce, template.Difficulty))
+				intHash.SetBytes(hash[:])
+				if intHash.Cmp(target) == -1 {
+					atomic.StoreInt32(&stop, 1)
+					found <- nonce
+					return
+				}
+			}
+		}(t)
+	}
+
+	wg.Wait()
+	close(found)
+
+	nonce, ok := <-found
+	return nonce, ok
+}
@@ -3,7 +3,6 @@ package network
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,10 +10,10 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
-	"github.com/dgraph-io/badger"
-
 	"github.com/vrecan/death/v3" // intercept Ctrl-C and close the database
 
 	"github.com/nclv/golang-blockchain/blockchain"
@@ -31,7 +30,12 @@ var (
 	networkMinerAddress string
 	KnownNodes          = []string{"localhost:3000"} // central node
 	blocksInTransmit    [][]byte
-	memoryPool          = make(map[string]blockchain.Transaction)
+	memoryPool          = NewMempool()
+	pruneDepth          int
+	validatingSnapshot  int32
+	// serializes the changes of the chain tip by the received, mined and
+	// submitted blocks
+	blockMutex sync.Mutex
 )
 
 type Addr struct {
@@ -68,6 +72,8 @@ type Version struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	Pruned     bool // non-archival node, only the last PruneDepth blocks can be requested
+	PruneDepth int
 }
 
 func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
@@ -91,7 +97,7 @@ func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
 	case "block":
 		HandleBlock(req, chain)
 	case "inv":
-		HandleInv(req)
+		HandleInv(req, chain)
 	case "getblocks":
 		HandleGetBlocks(req, chain)
 	case "getdata":
@@ -105,7 +111,7 @@ func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
 	}
 }
 
-func StartServer(nodeID, minerAddress string) {
+func StartServer(nodeID, minerAddress, workAddress string, prune int) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	networkMinerAddress = minerAddress
 	ln, err := net.Listen(protocol, nodeAddress)
@@ -120,13 +126,28 @@ func StartServer(nodeID, minerAddress string) {
 	}(ln)
 
 	chain := blockchain.ContinueBlockChain(nodeID)
-	defer func(Database *badger.DB) {
-		err := Database.Close()
+	defer func(chain *blockchain.BlockChain) {
+		err := chain.Close()
 		if err != nil {
 			log.Panic(err)
 		}
-	}(chain.Database)
+	}(chain)
 	go CloseDB(chain)
+	memoryPool.LoadFeeStats(chain)
+
+	// a pruned chain stays pruned even if the node is restarted without -prune
+	pruneDepth = prune
+	if pruneDepth == 0 {
+		pruneDepth = chain.PruneDepth()
+	}
+	if pruneDepth > 0 {
+		fmt.Printf("Pruning the block bodies deeper than %d blocks\n", pruneDepth)
+	}
+	go ValidateSnapshot(chain)
+
+	if len(workAddress) > 0 {
+		go StartWorkServer(workAddress, chain)
+	}
 
 	if nodeAddress != KnownNodes[0] {
 		SendVersion(KnownNodes[0], chain)
@@ -169,9 +190,36 @@ func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 	block := blockchain.DeserializeBlock(blockData)
 
 	fmt.Println("Received a new block!")
-	chain.AddBlock(block)
+	blockMutex.Lock()
+	if err := chain.ValidateBlock(block); err != nil {
+		blockMutex.Unlock()
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+		blocksInTransmit = nil
+		return
+	}
+	bestHeight := chain.GetBestHeight()
+	newTip := chain.AddBlock(block)
+	blockMutex.Unlock()
+
+	switch {
+	case newTip:
+		fmt.Printf("Added block %x\n", block.Hash)
+	case block.Height > bestHeight:
+		// the block is stored but its transactions could not be connected
+		fmt.Printf("Rejected block %x: it is not connected\n", block.Hash)
+		blocksInTransmit = nil
+		return
+	default:
+		fmt.Printf("Stored block %x on a side branch\n", block.Hash)
+	}
 
-	fmt.Printf("Added block %x\n", block.Hash)
+	if newTip {
+		memoryPool.RemoveBlock(block)
+		memoryPool.SaveFeeStats(chain)
+	}
+	if pruneDepth > 0 && newTip {
+		chain.Prune(pruneDepth)
+	}
 
 	// get the next block if there is one
 	if len(blocksInTransmit) > 0 {
@@ -180,8 +228,28 @@ func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 
 		blocksInTransmit = blocksInTransmit[1:]
 	} else {
-		UTXOSet := blockchain.UTXOSet{BlockChain: chain}
-		UTXOSet.Reindex()
+		go ValidateSnapshot(chain)
+	}
+}
+
+// ValidateSnapshot checks the history below a loaded UTXO snapshot once it
+// has been downloaded, the node stops if it does not match the snapshot
+func ValidateSnapshot(chain *blockchain.BlockChain) {
+	if !atomic.CompareAndSwapInt32(&validatingSnapshot, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&validatingSnapshot, 0)
+
+	if _, ok := chain.Snapshot(); !ok {
+		return
+	}
+
+	validated, err := chain.ValidateSnapshot()
+	if err != nil {
+		log.Panicf("The chain history does not match the UTXO snapshot: %s", err)
+	}
+	if validated {
+		fmt.Println("The history of the UTXO snapshot is validated")
 	}
 }
 
@@ -219,10 +287,9 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
-
-		SendTx(payload.AddrFrom, &tx)
+		if tx, ok := memoryPool.Get(payload.ID); ok {
+			SendTx(payload.AddrFrom, tx)
+		}
 	}
 }
 
@@ -239,7 +306,11 @@ func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 	bestHeight := chain.GetBestHeight()
 	otherHeight := payload.BestHeight
 	if bestHeight < otherHeight {
-		SendGetBlock(payload.AddrFrom)
+		if payload.Pruned && bestHeight < otherHeight-payload.PruneDepth {
+			fmt.Printf("%s is pruned and does not have the blocks we miss\n", payload.AddrFrom)
+		} else {
+			SendGetBlock(payload.AddrFrom)
+		}
 	} else if bestHeight > otherHeight {
 		SendVersion(payload.AddrFrom, chain)
 	}
@@ -261,9 +332,13 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 
 	txData := payload.Transaction
 	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	if err := memoryPool.Add(&tx, chain); err != nil {
+		fmt.Printf("Rejected transaction: %s\n", err)
+		return
+	}
+
+	fmt.Printf("%s, %d", nodeAddress, memoryPool.Len())
 
 	// if node address is the main/centralized node
 	if nodeAddress == KnownNodes[0] {
@@ -273,13 +348,13 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 			}
 		}
 	} else {
-		if len(memoryPool) >= 2 && len(networkMinerAddress) > 0 {
+		if memoryPool.Len() >= 2 && len(networkMinerAddress) > 0 {
 			MineTx(chain)
 		}
 	}
 }
 
-func HandleInv(request []byte) {
+func HandleInv(request []byte, chain *blockchain.BlockChain) {
 	var buff bytes.Buffer
 	var payload Inv
 
@@ -292,9 +367,19 @@ func HandleInv(request []byte) {
 	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransmit = payload.Items
+		// the inventory starts from the tip, request the missing blocks from
+		// the oldest so that each one can be validated against its ancestors
+		blocksInTransmit = nil
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if !chain.HasBlock(payload.Items[i]) {
+				blocksInTransmit = append(blocksInTransmit, payload.Items[i])
+			}
+		}
+		if len(blocksInTransmit) == 0 {
+			return
+		}
 
-		blockHash := payload.Items[0]
+		blockHash := blocksInTransmit[0]
 		SendGetData(payload.AddrFrom, "block", blockHash)
 
 		var newInTransit [][]byte
@@ -309,51 +394,65 @@ func HandleInv(request []byte) {
 	if payload.Type == "tx" {
 		txID := payload.Items[0]
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
+		if _, ok := memoryPool.Get(txID); !ok {
 			SendGetData(payload.AddrFrom, "tx", txID)
 		}
 	}
 }
 
 func MineTx(chain *blockchain.BlockChain) {
-	var txs []*blockchain.Transaction
-
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-		}
-	}
+	txs, fees := VerifiedMempoolTxs(chain)
 
 	if len(txs) == 0 {
 		fmt.Println("All transactions are invalid")
 		return
 	}
 
-	cbTx := blockchain.CoinbaseTx(networkMinerAddress, "")
+	cbTx := blockchain.CoinbaseTxWithFees(networkMinerAddress, "", fees)
 	txs = append(txs, cbTx)
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
-	UTXOSet.Reindex()
+	blockMutex.Lock()
+	newBlock, err := chain.MineBlock(txs)
+	blockMutex.Unlock()
+	if err != nil {
+		fmt.Printf("Block not mined: %s\n", err)
+		return
+	}
+	BlockMined(chain, newBlock)
 
-	fmt.Println("New block mined")
+	if memoryPool.Len() > 0 {
+		MineTx(chain)
+	}
+}
 
+// VerifiedMempoolTxs returns the memory pool transactions that can be mined in
+// the next block, parents first, with the sum of their fees
+func VerifiedMempoolTxs(chain *blockchain.BlockChain) ([]*blockchain.Transaction, int) {
+	txs, fees := memoryPool.BlockTxs(chain)
 	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+		fmt.Printf("tx: %x\n", tx.ID)
+	}
+
+	return txs, fees
+}
+
+// BlockMined prunes the chain, drops the mined transactions from the memory
+// pool and announces the block to the known nodes
+func BlockMined(chain *blockchain.BlockChain, newBlock *blockchain.Block) {
+	if pruneDepth > 0 {
+		chain.Prune(pruneDepth)
 	}
 
+	fmt.Println("New block mined")
+
+	memoryPool.RemoveBlock(newBlock)
+	memoryPool.SaveFeeStats(chain)
+
 	for _, node := range KnownNodes {
 		if node != nodeAddress {
 			SendInv(node, "block", [][]byte{newBlock.Hash})
 		}
 	}
-
-	if len(memoryPool) > 0 {
-		MineTx(chain)
-	}
 }
 
 func NodeIsKnown(address string) bool {
@@ -388,7 +487,7 @@ func CloseDB(chain *blockchain.BlockChain) {
 	d.WaitForDeathWithFunc(func() {
 		defer os.Exit(1)
 		defer runtime.Goexit()
-		err := chain.Database.Close()
+		err := chain.Close()
 		if err != nil {
 			return
 		}
@@ -443,7 +542,7 @@ func SendTx(address string, txn *blockchain.Transaction) {
 
 func SendVersion(address string, chain *blockchain.BlockChain) {
 	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+	payload := GobEncode(Version{version, bestHeight, nodeAddress, pruneDepth > 0, pruneDepth})
 	request := append(CmdToBytes("version"), payload...)
 
 	SendData(address, request)
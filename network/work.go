@@ -0,0 +1,272 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nclv/golang-blockchain/blockchain"
+)
+
+// Work server: newline delimited JSON requests over TCP, a worker asks for a
+// header template with "getwork" and sends back a found nonce with "submitwork"
+
+const maxWorkJobs = 64
+
+var errNoMinerAddress = errors.New("the node has no miner address to receive the rewards")
+
+var (
+	workMutex sync.Mutex
+	workJobs  = make(map[string]*blockchain.Block)
+	jobOrder  []string
+	jobCount  int
+	// the workers have been searching the next block since workStart, they
+	// are mining while they keep asking for work
+	workStart   time.Time
+	lastGetWork time.Time
+)
+
+type WorkRequest struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type WorkResponse struct {
+	ID     int         `json:"id"`
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type WorkTemplate struct {
+	JobID      string `json:"job_id"`
+	PrevHash   string `json:"prev_hash"`
+	MerkleRoot string `json:"merkle_root"`
+	Height     int    `json:"height"`
+	Timestamp  int64  `json:"timestamp"`
+	Difficulty int    `json:"difficulty"`
+	Target     string `json:"target"`
+}
+
+type MiningInfoParams struct {
+	Blocks int `json:"blocks"`
+}
+
+type EstimateFeeParams struct {
+	Blocks int `json:"blocks"`
+}
+
+type WorkSubmission struct {
+	JobID string `json:"job_id"`
+	Nonce int    `json:"nonce"`
+}
+
+// StartWorkServer serves the RPC methods, getwork and submitwork are refused
+// without a miner address to receive the rewards
+func StartWorkServer(address string, chain *blockchain.BlockChain) {
+	ln, err := net.Listen(protocol, address)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func(ln net.Listener) {
+		err := ln.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(ln)
+
+	fmt.Printf("Work server listening on %s\n", address)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Panic(err)
+		}
+		go HandleWorkConnection(conn, chain)
+	}
+}
+
+func HandleWorkConnection(conn net.Conn, chain *blockchain.BlockChain) {
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(conn)
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var request WorkRequest
+		var response WorkResponse
+
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			response.Error = err.Error()
+		} else {
+			response.ID = request.ID
+			result, err := HandleWorkRequest(request, chain)
+			if err != nil {
+				response.Error = err.Error()
+			}
+			response.Result = result
+		}
+
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+func HandleWorkRequest(request WorkRequest, chain *blockchain.BlockChain) (interface{}, error) {
+	switch request.Method {
+	case "getwork":
+		if len(networkMinerAddress) == 0 {
+			return nil, errNoMinerAddress
+		}
+		return GetWork(chain)
+	case "submitwork":
+		if len(networkMinerAddress) == 0 {
+			return false, errNoMinerAddress
+		}
+		var submission WorkSubmission
+		if err := json.Unmarshal(request.Params, &submission); err != nil {
+			return nil, err
+		}
+		if err := SubmitWork(submission, chain); err != nil {
+			return false, err
+		}
+		return true, nil
+	case "getmininginfo":
+		params := MiningInfoParams{Blocks: 10}
+		if len(request.Params) > 0 {
+			if err := json.Unmarshal(request.Params, &params); err != nil {
+				return nil, err
+			}
+		}
+		info := chain.MiningInfo(params.Blocks)
+		info.Mining = len(networkMinerAddress) > 0 || workersActive()
+		return info, nil
+	case "estimatefee":
+		params := EstimateFeeParams{Blocks: 6}
+		if len(request.Params) > 0 {
+			if err := json.Unmarshal(request.Params, &params); err != nil {
+				return nil, err
+			}
+		}
+		return memoryPool.EstimateFee(params.Blocks), nil
+	default:
+		return nil, fmt.Errorf("unknown method %q", request.Method)
+	}
+}
+
+// GetWork builds a block template from the memory pool and keeps it until a
+// worker submits a nonce for it or the job is evicted
+func GetWork(chain *blockchain.BlockChain) (WorkTemplate, error) {
+	if _, ok := blockchain.Engine.(*blockchain.PowEngine); !ok {
+		return WorkTemplate{}, errors.New("external mining needs the proof of work engine")
+	}
+
+	txs, fees := VerifiedMempoolTxs(chain)
+	txs = append(txs, blockchain.CoinbaseTxWithFees(networkMinerAddress, "", fees))
+
+	block := chain.NewBlockTemplate(txs)
+	pow := blockchain.NewProof(block)
+
+	workMutex.Lock()
+	defer workMutex.Unlock()
+
+	lastGetWork = time.Now()
+	if workStart.IsZero() {
+		workStart = lastGetWork
+	}
+
+	jobCount++
+	jobID := fmt.Sprintf("%x", jobCount)
+	workJobs[jobID] = block
+	jobOrder = append(jobOrder, jobID)
+	if len(jobOrder) > maxWorkJobs {
+		delete(workJobs, jobOrder[0])
+		jobOrder = jobOrder[1:]
+	}
+
+	return WorkTemplate{
+		JobID:      jobID,
+		PrevHash:   hex.EncodeToString(block.PrevHash),
+		MerkleRoot: hex.EncodeToString(block.HashTransactions()),
+		Height:     block.Height,
+		Timestamp:  block.Timestamp,
+		Difficulty: blockchain.Difficulty,
+		Target:     pow.Target.Text(16),
+	}, nil
+}
+
+// SubmitWork seals the block of a job with the nonce of a worker, the job is
+// only removed once the block is added so that a wrong nonce cannot cancel it
+func SubmitWork(submission WorkSubmission, chain *blockchain.BlockChain) error {
+	workMutex.Lock()
+	job, ok := workJobs[submission.JobID]
+	workMutex.Unlock()
+
+	if !ok {
+		return errors.New("unknown or expired job")
+	}
+
+	// the job is shared by the concurrent submissions
+	block := *job
+	pow := blockchain.NewProof(&block)
+	if !pow.Seal(submission.Nonce) {
+		return errors.New("nonce does not meet the target")
+	}
+
+	blockMutex.Lock()
+	if !bytes.Equal(block.PrevHash, chain.LastHash) {
+		blockMutex.Unlock()
+		return errors.New("stale job, the tip has changed")
+	}
+	added := chain.AddBlock(&block)
+	blockMutex.Unlock()
+
+	if !added {
+		return fmt.Errorf("block %x is not connected", block.Hash)
+	}
+
+	workMutex.Lock()
+	delete(workJobs, submission.JobID)
+	elapsed := time.Since(workStart)
+	workStart = time.Now()
+	workMutex.Unlock()
+
+	fmt.Printf("Worker found block %x\n", block.Hash)
+	blockchain.RecordBlockWork(&block, elapsed)
+	BlockMined(chain, &block)
+
+	return nil
+}
+
+// workersActive tells whether a worker asked for work within the delay after
+// which the workers refresh their template
+func workersActive() bool {
+	workMutex.Lock()
+	defer workMutex.Unlock()
+
+	return !lastGetWork.IsZero() && time.Since(lastGetWork) < 2*workRefresh
+}
+
+// parseTarget reads the hexadecimal target sent in a work template
+func parseTarget(target string) (*big.Int, error) {
+	t, ok := new(big.Int).SetString(target, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid target %q", target)
+	}
+
+	return t, nil
+}
@@ -6,14 +6,23 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"log"
 
+	"github.com/mr-tron/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
 	checksumLength = 4
-	version        = byte(0x00)
+
+	// version bytes of the addresses
+	PubKeyHashVersion = byte(0x00)
+	// the payload of a multisig address is its locking script
+	MultisigVersion = byte(0x06)
+	// the payload of a pay to script hash address is the hash of the redeem script
+	ScriptHashVersion = byte(0x05)
 )
 
 type Wallet struct {
@@ -24,27 +33,52 @@ type Wallet struct {
 func (w Wallet) Address() []byte {
 	pubHash := PublicKeyHash(w.PublicKey)
 
-	versionedHash := append([]byte{version}, pubHash...)
-	checksum := CheckSum(versionedHash)
-
-	fullHash := append(versionedHash, checksum...)
-	address := Base58Encode(fullHash)
-
 	// fmt.Printf("pub key: %x\n", w.PublicKey)
 	// fmt.Printf("pub hash: %x\n", pubHash)
-	// fmt.Printf("address: %s\n", address)
 
-	return address
+	return EncodeAddress(PubKeyHashVersion, pubHash)
+}
+
+// EncodeAddress returns the base58 encoding of payload with its version byte and checksum
+func EncodeAddress(version byte, payload []byte) []byte {
+	versionedPayload := append([]byte{version}, payload...)
+	checksum := CheckSum(versionedPayload)
+
+	fullPayload := append(versionedPayload, checksum...)
+
+	return Base58Encode(fullPayload)
+}
+
+// DecodeAddress returns the version byte and the payload of an address
+func DecodeAddress(address string) (byte, []byte, error) {
+	decoded, err := base58.Decode(address)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(decoded) <= 1+checksumLength {
+		return 0, nil, errors.New("address is too short")
+	}
+
+	version := decoded[0]
+	payload := decoded[1 : len(decoded)-checksumLength]
+	actualChecksum := decoded[len(decoded)-checksumLength:]
+	targetChecksum := CheckSum(append([]byte{version}, payload...))
+	if !bytes.Equal(actualChecksum, targetChecksum) {
+		return 0, nil, errors.New("invalid address checksum")
+	}
+
+	switch version {
+	case PubKeyHashVersion, MultisigVersion, ScriptHashVersion:
+		return version, payload, nil
+	default:
+		return 0, nil, fmt.Errorf("unknown address version %d", version)
+	}
 }
 
 func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
-	targetChecksum := CheckSum(append([]byte{version}, pubKeyHash...))
+	_, _, err := DecodeAddress(address)
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return err == nil
 }
 
 func NewKeyPair() (ecdsa.PrivateKey, []byte) {
@@ -55,9 +89,17 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Panic(err)
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	return *private, PublicKeyBytes(private.PublicKey)
+}
+
+// PublicKeyBytes encodes the coordinates of a public key on 32 bytes each, so
+// that they are split in half whatever their leading zeros
+func PublicKeyBytes(pub ecdsa.PublicKey) []byte {
+	encoded := make([]byte, 64)
+	pub.X.FillBytes(encoded[:32])
+	pub.Y.FillBytes(encoded[32:])
 
-	return *private, pub
+	return encoded
 }
 
 func MakeWallet() *Wallet {
@@ -37,6 +37,14 @@ func (ws *Wallets) LoadFile(nodeID string) error {
 
 	ws.Wallets = wallets.Wallets
 
+	// the keys created before the fixed size encoding are kept since the
+	// addresses hash them, a key of odd length cannot sign
+	for address, w := range ws.Wallets {
+		if len(w.PublicKey) != 64 {
+			fmt.Printf("Warning: %s has a legacy public key of %d bytes, send its coins to a new address\n", address, len(w.PublicKey))
+		}
+	}
+
 	return nil
 }
 